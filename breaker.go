@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// defaultSMTPFailureThreshold is the number of consecutive SMTP failures that
+// trips the circuit breaker when smtp_failure_threshold is not set.
+const defaultSMTPFailureThreshold = 5
+
+// errCircuitOpen is returned for sends attempted after the circuit breaker tripped.
+var errCircuitOpen = errors.New("SMTP circuit breaker is open after repeated failures, no more emails are sent in this run")
+
+// CircuitBreaker stops sending emails for the rest of a run once the SMTP
+// servers failed a number of times in a row.
+type CircuitBreaker struct {
+	threshold int
+	failures  int
+	open      bool
+	mu        sync.Mutex
+}
+
+// newCircuitBreaker creates a circuit breaker tripping after the given number
+// of consecutive failures. A threshold below 1 selects the default.
+//
+// @param threshold: consecutive failures before tripping
+// @return *CircuitBreaker: circuit breaker
+func newCircuitBreaker(threshold int) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = defaultSMTPFailureThreshold
+	}
+	return &CircuitBreaker{threshold: threshold}
+}
+
+// allow returns errCircuitOpen once the breaker has tripped.
+//
+// @return error: error if sending is not allowed
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return errCircuitOpen
+	}
+	return nil
+}
+
+// record records the result of a send. Successes reset the failure count.
+//
+// @param err: send error, nil on success
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if !b.open && b.failures >= b.threshold {
+		b.open = true
+		log.Printf("SMTP circuit breaker tripped after %d consecutive failures, skipping the remaining emails of this run", b.failures)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// checksumHeader is the message header listing the attachment checksums.
+const checksumHeader = "X-Attachment-SHA256"
+
+// attachmentChecksums returns the hex-encoded SHA-256 of each attachment, keyed
+// by file name.
+//
+// @param attachments: email attachments
+// @return map[string]string: checksums by file name
+func attachmentChecksums(attachments []Attachment) map[string]string {
+	checksums := make(map[string]string, len(attachments))
+	for _, attachment := range attachments {
+		sum := sha256.Sum256(attachment.file.Bytes())
+		checksums[attachment.fileName] = hex.EncodeToString(sum[:])
+	}
+	return checksums
+}
+
+// appendChecksums appends the file name and SHA-256 of each attachment to the
+// email body, so that recipients can verify the files they downloaded.
+//
+// @param body: email body
+// @param attachments: email attachments
+// @param checksums: checksums by file name
+// @return string: email body with the checksum list
+func appendChecksums(body string, attachments []Attachment, checksums map[string]string) string {
+	if len(attachments) == 0 {
+		return body
+	}
+
+	lines := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		lines[i] = fmt.Sprintf("- %s: %s", attachment.fileName, checksums[attachment.fileName])
+	}
+	return body + "\r\n\r\nSHA-256 checksums:\r\n\r\n" + strings.Join(lines, "\r\n")
+}
+
+// checksumHeaderValue returns the value of the checksum header: name=checksum
+// pairs separated by semicolons, one per folded line. Non-ASCII file names are
+// encoded as MIME encoded words.
+//
+// @param attachments: email attachments
+// @param checksums: checksums by file name
+// @return string: header value
+func checksumHeaderValue(attachments []Attachment, checksums map[string]string) string {
+	pairs := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		pairs[i] = fmt.Sprintf("%s=%s", mime.QEncoding.Encode("utf-8", attachment.fileName), checksums[attachment.fileName])
+	}
+	return strings.Join(pairs, ";\r\n ")
+}
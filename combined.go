@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// combinedSheet is a table export written as a sheet of the combined workbook.
+type combinedSheet struct {
+	name   string
+	result *ResultSet
+	config TableAttachmentConfig
+}
+
+// writeCombinedWorkbook writes the already exported tables of a post into one
+// workbook, one sheet per table named after its attachment file.
+//
+// @param fileName: workbook file name
+// @param sheets: table exports
+// @return Attachment: workbook attachment
+// @return error: error if any
+func writeCombinedWorkbook(fileName string, sheets []combinedSheet) (Attachment, error) {
+	logInfof("Writing combined workbook %s with %d sheet(s)", fileName, len(sheets))
+
+	file := excelize.NewFile()
+	defer file.Close()
+
+	usedNames := make(map[string]bool)
+	rows := 0
+	for i, sheet := range sheets {
+		sheetName := uniqueSheetName(strings.TrimSuffix(sheet.name, path.Ext(sheet.name)), usedNames)
+		if i == 0 {
+			if err := file.SetSheetName("Sheet1", sheetName); err != nil {
+				log.Printf("Failed to rename Excel sheet: %v", err)
+				return Attachment{}, err
+			}
+		} else if _, err := file.NewSheet(sheetName); err != nil {
+			log.Printf("Failed to create Excel sheet: %v", err)
+			return Attachment{}, err
+		}
+
+		if err := writeSheet(file, sheetName, sheet.result, sheet.config); err != nil {
+			log.Printf("Failed to write sheet %s of %s: %v", sheetName, fileName, err)
+			return Attachment{}, err
+		}
+		rows += len(sheet.result.Rows)
+	}
+	file.SetActiveSheet(0)
+
+	buffer := new(bytes.Buffer)
+	if err := file.Write(buffer); err != nil {
+		log.Printf("Failed to write Excel file to buffer: %v", err)
+		return Attachment{}, err
+	}
+
+	return Attachment{
+		fileName: fileName,
+		mimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		file:     buffer,
+		rows:     rows,
+	}, nil
+}
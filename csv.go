@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// csvComma returns the configured CSV delimiter, defaulting to a comma.
+//
+// @return rune: CSV delimiter
+// @return error: error if the delimiter is not a single valid character
+func (c TableAttachmentConfig) csvComma() (rune, error) {
+	if c.CSVDelimiter == "" {
+		return ',', nil
+	}
+
+	comma, size := utf8.DecodeRuneInString(c.CSVDelimiter)
+	if size != len(c.CSVDelimiter) || comma == utf8.RuneError || comma == '"' || comma == '\r' || comma == '\n' {
+		return 0, fmt.Errorf("invalid CSV delimiter %q", c.CSVDelimiter)
+	}
+	return comma, nil
+}
+
+// utf8BOM is the UTF-8 byte order mark, which Excel needs to detect UTF-8 CSV files.
+const utf8BOM = "\xef\xbb\xbf"
+
+// writeCSV writes a result set to a CSV file. NULL values are written as empty
+// fields. With csv_bom set, the file starts with a UTF-8 byte order mark.
+//
+// @param result: table rows
+// @param attachmentConfig: table attachment configuration
+// @return *bytes.Buffer: CSV file buffer
+// @return error: error if any
+func writeCSV(result *ResultSet, attachmentConfig TableAttachmentConfig) (*bytes.Buffer, error) {
+	writer, err := newCSVTableWriter(result.Columns, attachmentConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := writer.writeRows(result.Rows); err != nil {
+		return nil, err
+	}
+	return writer.finish()
+}
+
+// csvTableWriter writes the rows of a table to a CSV file as they are read, so
+// that paged exports do not hold the whole table.
+type csvTableWriter struct {
+	buffer *bytes.Buffer
+	writer *csv.Writer
+	write  func(record []string) error
+	record []string
+}
+
+// newCSVTableWriter starts a CSV file with the header row.
+//
+// @param columns: column names
+// @param attachmentConfig: table attachment configuration
+// @return *csvTableWriter: CSV writer
+// @return error: error if any
+func newCSVTableWriter(columns []string, attachmentConfig TableAttachmentConfig) (*csvTableWriter, error) {
+	comma, err := attachmentConfig.csvComma()
+	if err != nil {
+		log.Printf("Failed to write CSV file: %v", err)
+		return nil, err
+	}
+
+	w := &csvTableWriter{buffer: new(bytes.Buffer), record: make([]string, len(columns))}
+	if attachmentConfig.CSVBOM {
+		w.buffer.WriteString(utf8BOM)
+	}
+	w.writer = csv.NewWriter(w.buffer)
+	w.writer.Comma = comma
+
+	w.write = w.writer.Write
+	if attachmentConfig.CSVQuoteAll {
+		w.write = func(record []string) error {
+			return writeQuotedRecord(w.buffer, record, comma)
+		}
+	}
+
+	if err := w.write(columns); err != nil {
+		log.Printf("Failed to write CSV header: %v", err)
+		return nil, err
+	}
+	return w, nil
+}
+
+// writeRows appends rows to the CSV file.
+//
+// @param rows: raw column values; a nil value represents NULL
+// @return error: error if any
+func (w *csvTableWriter) writeRows(rows [][][]byte) error {
+	for _, row := range rows {
+		for i, value := range row {
+			w.record[i] = string(value)
+		}
+		if err := w.write(w.record); err != nil {
+			log.Printf("Failed to write CSV row: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// finish flushes the CSV file.
+//
+// @return *bytes.Buffer: CSV file buffer
+// @return error: error if any
+func (w *csvTableWriter) finish() (*bytes.Buffer, error) {
+	w.writer.Flush()
+	if err := w.writer.Error(); err != nil {
+		log.Printf("Failed to flush CSV file: %v", err)
+		return nil, err
+	}
+	return w.buffer, nil
+}
+
+// writeQuotedRecord writes a CSV record with every field quoted, as
+// encoding/csv only quotes fields that need it.
+//
+// @param w: output writer
+// @param record: field values
+// @param comma: field delimiter
+// @return error: error if any
+func writeQuotedRecord(w io.Writer, record []string, comma rune) error {
+	fields := make([]string, len(record))
+	for i, field := range record {
+		fields[i] = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+	}
+	_, err := io.WriteString(w, strings.Join(fields, string(comma))+"\n")
+	return err
+}
+
+// zipAttachments bundles attachments into a single ZIP archive, with one entry
+// per attachment named after its file name.
+//
+// @param fileName: archive file name
+// @param attachments: attachments to bundle
+// @return Attachment: ZIP archive attachment
+// @return error: error if any
+func zipAttachments(fileName string, attachments []Attachment) (Attachment, error) {
+	buffer := new(bytes.Buffer)
+	writer := zip.NewWriter(buffer)
+	now := time.Now()
+	for _, attachment := range attachments {
+		entry, err := writer.CreateHeader(&zip.FileHeader{
+			Name:     attachment.fileName,
+			Method:   zip.Deflate,
+			Modified: now,
+		})
+		if err != nil {
+			return Attachment{}, err
+		}
+		if _, err := entry.Write(attachment.file.Bytes()); err != nil {
+			return Attachment{}, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return Attachment{}, err
+	}
+
+	return Attachment{
+		fileName: fileName,
+		mimeType: "application/zip",
+		file:     buffer,
+	}, nil
+}
+
+// readRecipientsFile reads recipient addresses from a column of a CSV file with
+// a header row. Without a column name, the first column is read. Empty cells
+// are ignored.
+//
+// @param path: CSV file path
+// @param column: header of the address column, empty for the first column
+// @return []string: addresses in file order
+// @return error: error if any
+func readRecipientsFile(path, column string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open recipients file: %v", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read recipients file %s: %v", path, err)
+		return nil, err
+	}
+
+	index := 0
+	if column != "" {
+		index = -1
+		for i, name := range header {
+			// Spreadsheet exports often start with a byte order mark
+			if strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")), column) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			err := fmt.Errorf("recipients file %s has no column %q", path, column)
+			log.Printf("Failed to read recipients file: %v", err)
+			return nil, err
+		}
+	}
+
+	addresses := make([]string, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to read recipients file %s: %v", path, err)
+			return nil, err
+		}
+		if index < len(record) && strings.TrimSpace(record[index]) != "" {
+			addresses = append(addresses, record[index])
+		}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteCSV(t *testing.T) {
+	result := &ResultSet{
+		Columns: []string{"ID", "NAME", "NOTE"},
+		Rows: [][][]byte{
+			{[]byte("1"), []byte("Zoë"), []byte(`say "hi"`)},
+			{[]byte("2"), []byte("a,b;c"), nil},
+			{[]byte("3"), []byte("two\nlines"), []byte("")},
+		},
+	}
+	tests := []struct {
+		name    string
+		config  TableAttachmentConfig
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "default",
+			config: TableAttachmentConfig{},
+			want:   "ID,NAME,NOTE\n1,Zoë,\"say \"\"hi\"\"\"\n2,\"a,b;c\",\n3,\"two\nlines\",\n",
+		},
+		{
+			name:   "semicolon",
+			config: TableAttachmentConfig{CSVDelimiter: ";"},
+			want:   "ID;NAME;NOTE\n1;Zoë;\"say \"\"hi\"\"\"\n2;\"a,b;c\";\n3;\"two\nlines\";\n",
+		},
+		{
+			name:   "tab",
+			config: TableAttachmentConfig{CSVDelimiter: "\t"},
+			want:   "ID\tNAME\tNOTE\n1\tZoë\t\"say \"\"hi\"\"\"\n2\ta,b;c\t\n3\t\"two\nlines\"\t\n",
+		},
+		{
+			name:   "quote all",
+			config: TableAttachmentConfig{CSVQuoteAll: true},
+			want:   "\"ID\",\"NAME\",\"NOTE\"\n\"1\",\"Zoë\",\"say \"\"hi\"\"\"\n\"2\",\"a,b;c\",\"\"\n\"3\",\"two\nlines\",\"\"\n",
+		},
+		{
+			name:   "quote all with delimiter",
+			config: TableAttachmentConfig{CSVQuoteAll: true, CSVDelimiter: "|"},
+			want:   "\"ID\"|\"NAME\"|\"NOTE\"\n\"1\"|\"Zoë\"|\"say \"\"hi\"\"\"\n\"2\"|\"a,b;c\"|\"\"\n\"3\"|\"two\nlines\"|\"\"\n",
+		},
+		{
+			name:   "bom",
+			config: TableAttachmentConfig{CSVBOM: true},
+			want:   utf8BOM + "ID,NAME,NOTE\n1,Zoë,\"say \"\"hi\"\"\"\n2,\"a,b;c\",\n3,\"two\nlines\",\n",
+		},
+		{"quote delimiter", TableAttachmentConfig{CSVDelimiter: `"`}, "", "invalid CSV delimiter"},
+		{"several characters", TableAttachmentConfig{CSVDelimiter: ";;"}, "", "invalid CSV delimiter"},
+		{"newline delimiter", TableAttachmentConfig{CSVDelimiter: "\n"}, "", "invalid CSV delimiter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer, err := writeCSV(result, tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("writeCSV error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("writeCSV: %v", err)
+			}
+			if got := buffer.String(); got != tt.want {
+				t.Errorf("writeCSV =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSVTableWriterPages(t *testing.T) {
+	writer, err := newCSVTableWriter([]string{"ID", "NAME"}, TableAttachmentConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := [][][][]byte{
+		{{[]byte("1"), []byte("a")}, {[]byte("2"), nil}},
+		{{[]byte("3"), []byte("c")}},
+		{},
+	}
+	for _, page := range pages {
+		if err := writer.writeRows(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buffer, err := writer.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buffer.String(), "ID,NAME\n1,a\n2,\n3,c\n"; got != want {
+		t.Errorf("paged CSV = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultDBRetryDelay is the pause between connection attempts when
+// db_connect_retry_delay_seconds is not set.
+const defaultDBRetryDelay = 5 * time.Second
+
+// Databases holds a connection pool per configured database. The default
+// database from "db" is stored under the empty name. It is safe for concurrent
+// use by the posts of a run: a database is connected to once, while the other
+// databases stay available.
+type Databases struct {
+	configs    map[string]DBConfig
+	pools      map[string]*sql.DB
+	connecting map[string]*sync.Mutex
+	retries    int
+	retryDelay time.Duration
+	closed     bool
+	mu         sync.Mutex
+}
+
+// openDatabases connects to the default database and to every named database.
+// With lazy_db_connect set, no connection is made until a database is first used.
+//
+// @param ctx: run context
+// @param config: configuration
+// @return *Databases: connection pools by database name
+// @return error: error if any
+func openDatabases(ctx context.Context, config Config) (*Databases, error) {
+	dbs := &Databases{
+		configs:    map[string]DBConfig{"": config.DB},
+		pools:      make(map[string]*sql.DB),
+		connecting: make(map[string]*sync.Mutex),
+		retries:    config.DBConnectRetries,
+		retryDelay: time.Duration(config.DBRetryDelay) * time.Second,
+	}
+	if dbs.retryDelay <= 0 {
+		dbs.retryDelay = defaultDBRetryDelay
+	}
+	for name, dbConfig := range config.Databases {
+		dbs.configs[name] = dbConfig
+	}
+	if config.LazyDBConnect {
+		return dbs, nil
+	}
+
+	names := make([]string, 0, len(dbs.configs))
+	for name := range dbs.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := dbs.get(ctx, name); err != nil {
+			dbs.Close()
+			return nil, err
+		}
+	}
+	return dbs, nil
+}
+
+// get returns the connection pool of a database, connecting to it on first use.
+// A failed connection is retried up to db_connect_retries times. Callers of the
+// same database wait for the connection in progress; other databases are not
+// blocked by it.
+//
+// @param ctx: run context
+// @param name: database name, empty for the default database
+// @return *sql.DB: connection pool
+// @return error: error if any
+func (d *Databases) get(ctx context.Context, name string) (*sql.DB, error) {
+	d.mu.Lock()
+	db, err := d.pool(name)
+	if db != nil || err != nil {
+		d.mu.Unlock()
+		return db, err
+	}
+	dbConfig, ok := d.configs[name]
+	if !ok {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	lock, ok := d.connecting[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		d.connecting[name] = lock
+	}
+	d.mu.Unlock()
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another caller may have connected while this one waited
+	d.mu.Lock()
+	db, err = d.pool(name)
+	d.mu.Unlock()
+	if db != nil || err != nil {
+		return db, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		db, err = createDMDB(dbConfig.Username, dbConfig.Password, dbConfig.Host, fmt.Sprintf("%d", dbConfig.Port), dbConfig.dsnParams())
+		if err == nil || attempt > d.retries || ctx.Err() != nil {
+			break
+		}
+		log.Printf("Failed to connect to %s, retrying in %s (%d/%d): %v", databaseLabel(name), d.retryDelay, attempt, d.retries, err)
+		if sleepContext(ctx, d.retryDelay) != nil {
+			break
+		}
+	}
+	if err != nil {
+		if name == "" {
+			return nil, err
+		}
+		return nil, fmt.Errorf("database %s: %w", name, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		db.Close()
+		return nil, fmt.Errorf("database connections are closed")
+	}
+	d.pools[name] = db
+	return db, nil
+}
+
+// pool returns the connection pool of a database if it is connected. The
+// caller must hold the mutex.
+//
+// @param name: database name, empty for the default database
+// @return *sql.DB: connection pool, nil if not connected yet
+// @return error: error if the connections are closed
+func (d *Databases) pool(name string) (*sql.DB, error) {
+	if d.closed {
+		return nil, fmt.Errorf("database connections are closed")
+	}
+	return d.pools[name], nil
+}
+
+// Close closes all connection pools. No new connections are made afterwards.
+func (d *Databases) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	for _, db := range d.pools {
+		db.Close()
+	}
+}
+
+// postReaders hands out the queryer used to read each database of a post. With
+// a snapshot, every database is read inside its own read-only transaction.
+type postReaders struct {
+	ctx      context.Context
+	dbs      *Databases
+	snapshot bool
+	readers  map[string]queryer
+	txs      []*sql.Tx
+}
+
+// get returns the queryer of a database, starting its transaction on first use
+// when reading a snapshot.
+//
+// @param name: database name, empty for the default database
+// @return queryer: queryer of the database
+// @return error: error if any
+func (r *postReaders) get(name string) (queryer, error) {
+	if reader, ok := r.readers[name]; ok {
+		return reader, nil
+	}
+
+	db, err := r.dbs.get(r.ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if r.readers == nil {
+		r.readers = make(map[string]queryer)
+	}
+	if !r.snapshot {
+		r.readers[name] = db
+		return db, nil
+	}
+
+	tx, err := db.BeginTx(r.ctx, &sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true})
+	if err != nil {
+		log.Printf("Failed to start read-only transaction: %v", err)
+		return nil, err
+	}
+	r.txs = append(r.txs, tx)
+	r.readers[name] = tx
+	return tx, nil
+}
+
+// release rolls back the snapshot transactions. The readers must not be used
+// afterwards.
+func (r *postReaders) release() {
+	for _, tx := range r.txs {
+		tx.Rollback()
+	}
+	r.txs = nil
+	r.readers = nil
+}
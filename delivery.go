@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery statuses.
+const (
+	deliverySent     = "sent"
+	deliveryRejected = "rejected"
+	deliveryFailed   = "failed"
+	deliverySkipped  = "skipped"
+)
+
+// DeliveryRecord describes the outcome of sending a post to one recipient.
+type DeliveryRecord struct {
+	Post      string        `json:"post"`
+	Recipient string        `json:"recipient"`
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	Bytes     int           `json:"bytes"`
+	Duration  time.Duration `json:"duration"`
+	Time      time.Time     `json:"time"`
+}
+
+// ExportRecord describes one exported attachment. Duration covers querying the
+// data and writing the files of its attachment configuration.
+type ExportRecord struct {
+	Post     string        `json:"post"`
+	File     string        `json:"file"`
+	Rows     int           `json:"rows"`
+	Bytes    int           `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+// DeliveryReport collects the export and delivery records of a run. It is safe
+// for concurrent use by the posts of a run.
+type DeliveryReport struct {
+	entries []DeliveryRecord
+	exports []ExportRecord
+	mu      sync.Mutex
+}
+
+// add appends a delivery record.
+//
+// @param post: post subject
+// @param recipient: recipient address
+// @param status: delivery status
+// @param err: delivery error, nil if none
+// @param bytes: size of the sent message
+// @param duration: time spent sending
+func (r *DeliveryReport) add(post string, recipient string, status string, err error, bytes int, duration time.Duration) {
+	record := DeliveryRecord{
+		Post:      post,
+		Recipient: recipient,
+		Status:    status,
+		Bytes:     bytes,
+		Duration:  duration,
+		Time:      time.Now(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, record)
+}
+
+// records returns the collected delivery records.
+//
+// @return []DeliveryRecord: delivery records in the order they were added
+func (r *DeliveryReport) records() []DeliveryRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]DeliveryRecord{}, r.entries...)
+}
+
+// addExport appends an export record.
+//
+// @param post: post subject
+// @param attachment: exported attachment
+// @param duration: time spent exporting
+func (r *DeliveryReport) addExport(post string, attachment Attachment, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.exports = append(r.exports, ExportRecord{
+		Post:     post,
+		File:     attachment.fileName,
+		Rows:     attachment.rows,
+		Bytes:    attachment.file.Len(),
+		Duration: duration,
+	})
+}
+
+// exportRecords returns the collected export records.
+//
+// @return []ExportRecord: export records in the order they were added
+func (r *DeliveryReport) exportRecords() []ExportRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ExportRecord{}, r.exports...)
+}
+
+// formatExportRecords formats export records as a plain text table for the
+// administrator emails, one line per attachment.
+//
+// @param exports: export records
+// @return string: formatted table
+func formatExportRecords(exports []ExportRecord) string {
+	lines := []string{"Exports (post / file: duration, rows, bytes):"}
+	for _, export := range exports {
+		lines = append(lines, fmt.Sprintf("- %s / %s: %s, %d rows, %d bytes",
+			export.Post, export.File, export.Duration.Round(time.Millisecond), export.Rows, export.Bytes))
+	}
+	if len(exports) == 0 {
+		lines = append(lines, "- none")
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// finalRecords returns the last delivery record of each post and recipient,
+// which holds its status after all retries.
+//
+// @return []DeliveryRecord: final records in the order recipients were first seen
+func (r *DeliveryReport) finalRecords() []DeliveryRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	index := make(map[[2]string]int)
+	final := make([]DeliveryRecord, 0, len(r.entries))
+	for _, record := range r.entries {
+		key := [2]string{record.Post, record.Recipient}
+		if i, ok := index[key]; ok {
+			// A later "skipped" only means the recipient was already delivered
+			if record.Status != deliverySkipped {
+				final[i] = record
+			}
+			continue
+		}
+		index[key] = len(final)
+		final = append(final, record)
+	}
+	return final
+}
+
+// logDeliverySummary logs the number of recipients per final status and the
+// recipients that did not receive their post.
+//
+// @param final: final delivery records
+func logDeliverySummary(final []DeliveryRecord) {
+	counts := make(map[string]int)
+	for _, record := range final {
+		counts[record.Status]++
+		if record.Status == deliveryRejected || record.Status == deliveryFailed {
+			log.Printf("Post %q was not delivered to %s (%s): %s", record.Post, record.Recipient, record.Status, record.Error)
+		}
+	}
+	logInfof("Delivery summary: %d sent, %d rejected, %d failed, %d skipped",
+		counts[deliverySent], counts[deliveryRejected], counts[deliveryFailed], counts[deliverySkipped])
+}
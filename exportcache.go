@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// exportCache holds the table exports of a run, so that posts exporting the same
+// table with the same options read it once. Entries are keyed by the attachment
+// configuration without its file name and the options applied after the export,
+// which covers the database, the query and the formats along with every option
+// that changes the written files. It is safe for concurrent use; a post waits
+// for an identical export in progress.
+type exportCache struct {
+	mu      sync.Mutex
+	entries map[string]*exportCacheEntry
+}
+
+// exportCacheEntry is a table export shared by the posts of a run.
+type exportCacheEntry struct {
+	once        sync.Once
+	attachments []Attachment
+	err         error
+}
+
+// exportCacheFileName is the file name cached exports are written under.
+const exportCacheFileName = "export.xlsx"
+
+// newExportCache returns an empty export cache.
+//
+// @return *exportCache: export cache
+func newExportCache() *exportCache {
+	return &exportCache{entries: make(map[string]*exportCacheEntry)}
+}
+
+// exportCacheConfig returns the configuration an attachment is exported with
+// through the cache, which also keys the cache: the attachment configuration
+// under the fixed cache file name, without the options applied after the export.
+//
+// @param attachmentConfig: table attachment configuration
+// @return TableAttachmentConfig: configuration of the cached export
+func exportCacheConfig(attachmentConfig TableAttachmentConfig) TableAttachmentConfig {
+	// The export is written under a fixed name, which each caller replaces
+	keyConfig := attachmentConfig
+	keyConfig.Excel = exportCacheFileName
+	keyConfig.Order = 0
+	keyConfig.Encoding = ""
+	keyConfig.MimeType = ""
+	keyConfig.AttachQuery = false
+	keyConfig.SendIfChanged = false
+	keyConfig.TransformCmd = nil
+	keyConfig.TransformExt = ""
+	keyConfig.TransformWait = 0
+	keyConfig.GoogleSheet = nil
+	return keyConfig
+}
+
+// exportTable exports a table, reusing the files of an earlier identical export
+// of the run. Each caller gets its own copy of the files, named after its own
+// configuration. A nil cache exports the table every time, and so does an
+// attachment refreshing its materialized view, which must read the refreshed
+// data rather than an export taken before.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return []Attachment: exported files, one per format
+// @return error: error if any
+func (c *exportCache) exportTable(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) ([]Attachment, error) {
+	if c == nil || attachmentConfig.Refresh {
+		return exportTable(ctx, db, attachmentConfig)
+	}
+
+	keyConfig := exportCacheConfig(attachmentConfig)
+	key, err := json.Marshal(keyConfig)
+	if err != nil {
+		log.Printf("Failed to build export cache key of table %s: %v", attachmentConfig.Table, err)
+		return exportTable(ctx, db, attachmentConfig)
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[string(key)]
+	if !ok {
+		entry = &exportCacheEntry{}
+		c.entries[string(key)] = entry
+	}
+	c.mu.Unlock()
+
+	reused := true
+	entry.once.Do(func() {
+		reused = false
+		entry.attachments, entry.err = exportTable(ctx, db, keyConfig)
+	})
+	if entry.err != nil {
+		return nil, entry.err
+	}
+	if reused {
+		logInfof("Reusing the export of table %s from an earlier post of this run", attachmentConfig.Table)
+	}
+
+	// The file name may be resolved from the data, so it is resolved again for
+	// this attachment
+	if len(entry.attachments) > 0 {
+		if attachmentConfig.Excel, err = resolveFileName(attachmentConfig.Excel, entry.attachments[0].result); err != nil {
+			log.Printf("Failed to resolve file name of table %s: %v", attachmentConfig.Table, err)
+			return nil, err
+		}
+	}
+
+	// The buffers are drained when sent, so every post gets its own copy
+	attachments := make([]Attachment, len(entry.attachments))
+	for i, format := range attachmentConfig.formats() {
+		attachments[i] = entry.attachments[i]
+		attachments[i].fileName = attachmentConfig.fileName(format)
+		attachments[i].file = bytes.NewBuffer(bytes.Clone(entry.attachments[i].file.Bytes()))
+	}
+	return attachments, nil
+}
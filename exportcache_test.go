@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestExportCacheConfig(t *testing.T) {
+	base := TableAttachmentConfig{Table: "SALES", Excel: "sales.xlsx", Formats: []string{formatXLSX}}
+	tests := []struct {
+		name   string
+		change func(*TableAttachmentConfig)
+		same   bool
+	}{
+		{"file name", func(c *TableAttachmentConfig) { c.Excel = "other_{{.date}}.xlsx" }, true},
+		{"order", func(c *TableAttachmentConfig) { c.Order = 2 }, true},
+		{"encoding", func(c *TableAttachmentConfig) { c.Encoding = encoding8Bit }, true},
+		{"send if changed", func(c *TableAttachmentConfig) { c.SendIfChanged = true }, true},
+		{"google sheet", func(c *TableAttachmentConfig) { c.GoogleSheet = &GoogleSheetConfig{SpreadsheetID: "1"} }, true},
+		{"table", func(c *TableAttachmentConfig) { c.Table = "STOCK" }, false},
+		{"database", func(c *TableAttachmentConfig) { c.Database = "archive" }, false},
+		{"formats", func(c *TableAttachmentConfig) { c.Formats = []string{formatCSV} }, false},
+		{"refresh", func(c *TableAttachmentConfig) { c.Refresh = true }, false},
+	}
+	key := func(config TableAttachmentConfig) string {
+		data, err := json.Marshal(exportCacheConfig(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := base
+			tt.change(&changed)
+			if same := key(base) == key(changed); same != tt.same {
+				t.Errorf("same cache key = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+// countingQueryer counts the queries run on a database.
+type countingQueryer struct {
+	*sql.DB
+	queries atomic.Int32
+}
+
+func (q *countingQueryer) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	q.queries.Add(1)
+	return q.DB.QueryContext(ctx, query, args...)
+}
+
+func TestExportCacheRefresh(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("CREATE TABLE SALES (ID INTEGER); INSERT INTO SALES VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		refresh bool
+		queries int32
+	}{
+		{"reused", false, 1},
+		{"refresh reads again", true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &countingQueryer{DB: db}
+			cache := newExportCache()
+			config := TableAttachmentConfig{Table: "SALES", Excel: "sales.csv", Formats: []string{formatCSV}, Refresh: tt.refresh}
+			for i := 0; i < 2; i++ {
+				if _, err := cache.exportTable(context.Background(), reader, config); err != nil {
+					t.Fatalf("exportTable: %v", err)
+				}
+			}
+			if got := reader.queries.Load(); got != tt.queries {
+				t.Errorf("%d queries, want %d", got, tt.queries)
+			}
+		})
+	}
+}
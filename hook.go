@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// defaultPostRunTimeout bounds the post-run command when no timeout is configured.
+const defaultPostRunTimeout = 5 * time.Minute
+
+// runPostRunCommand runs the configured post-run command through the system
+// shell once a run has finished. The outcome of the run is passed in
+// DMMAILER_* environment variables, and the command output is logged. A failing
+// command does not change the outcome of the run.
+//
+// @param config: configuration
+// @param attempts: number of attempts made
+// @param taskErr: error of the last attempt, nil if the run succeeded
+// @param final: final delivery records of the run
+// @return error: error if any
+func runPostRunCommand(config Config, attempts int, taskErr error, final []DeliveryRecord) error {
+	timeout := defaultPostRunTimeout
+	if config.PostRunTimeout > 0 {
+		timeout = time.Duration(config.PostRunTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var command *exec.Cmd
+	if runtime.GOOS == "windows" {
+		command = exec.CommandContext(ctx, "cmd", "/C", config.PostRunCommand)
+	} else {
+		command = exec.CommandContext(ctx, "sh", "-c", config.PostRunCommand)
+	}
+
+	counts := make(map[string]int)
+	for _, record := range final {
+		counts[record.Status]++
+	}
+	status, message := "success", ""
+	if taskErr != nil {
+		status, message = "failure", taskErr.Error()
+	}
+	command.Env = append(os.Environ(),
+		"DMMAILER_STATUS="+status,
+		"DMMAILER_ERROR="+message,
+		fmt.Sprintf("DMMAILER_ATTEMPTS=%d", attempts),
+		fmt.Sprintf("DMMAILER_SENT=%d", counts[deliverySent]),
+		fmt.Sprintf("DMMAILER_REJECTED=%d", counts[deliveryRejected]),
+		fmt.Sprintf("DMMAILER_FAILED=%d", counts[deliveryFailed]),
+	)
+
+	logInfof("Running post-run command: %s", config.PostRunCommand)
+	output, err := command.CombinedOutput()
+	if text := strings.TrimSpace(string(output)); text != "" {
+		logInfof("Post-run command output:\n%s", text)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/robfig/cron/v3"
+)
+
+// prompter asks questions on a terminal and reads the answers.
+type prompter struct {
+	scanner *bufio.Scanner
+	out     io.Writer
+}
+
+// ask prints a question and reads the answer, using the default value when the
+// answer is empty. Answers are checked with validate, if given, and the question
+// is repeated until the answer is valid.
+//
+// @param question: question text
+// @param defaultValue: default answer
+// @param validate: answer check, may be nil
+// @return string: answer
+// @return error: error if the input ended
+func (p *prompter) ask(question string, defaultValue string, validate func(string) error) (string, error) {
+	for {
+		if defaultValue != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, defaultValue)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+
+		if !p.scanner.Scan() {
+			if err := p.scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+
+		answer := strings.TrimSpace(p.scanner.Text())
+		if answer == "" {
+			answer = defaultValue
+		}
+		if validate == nil {
+			return answer, nil
+		}
+		if err := validate(answer); err != nil {
+			fmt.Fprintf(p.out, "  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// askPort asks for a TCP port.
+//
+// @param question: question text
+// @param defaultValue: default port
+// @return int: port
+// @return error: error if the input ended
+func (p *prompter) askPort(question string, defaultValue int) (int, error) {
+	answer, err := p.ask(question, strconv.Itoa(defaultValue), func(value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("port must be a number between 1 and 65535")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	port, _ := strconv.Atoi(answer)
+	return port, nil
+}
+
+// required rejects empty answers.
+//
+// @param value: answer
+// @return error: error if the answer is empty
+func required(value string) error {
+	if value == "" {
+		return errors.New("a value is required")
+	}
+	return nil
+}
+
+// validateAddresses checks a comma-separated list of email addresses.
+//
+// @param value: answer
+// @return error: error if an address is invalid
+func validateAddresses(value string) error {
+	if value == "" {
+		return errors.New("at least one address is required")
+	}
+	for _, address := range strings.Split(value, ",") {
+		if _, err := mail.ParseAddress(strings.TrimSpace(address)); err != nil {
+			return fmt.Errorf("invalid address %q", strings.TrimSpace(address))
+		}
+	}
+	return nil
+}
+
+// runInit asks for the SMTP and database settings and a first post, and writes
+// them as a new config file. An existing file is never overwritten.
+//
+// @param in: answers
+// @param out: questions and messages
+// @param configPath: path of the config file to write
+// @return error: error if any
+func runInit(in io.Reader, out io.Writer, configPath string) error {
+	if _, err := os.Stat(configPath); err == nil {
+		return fmt.Errorf("%s already exists", configPath)
+	}
+
+	p := &prompter{scanner: bufio.NewScanner(in), out: out}
+	fmt.Fprintf(out, "Creating %s. Press Enter to accept the value in brackets.\n\n", configPath)
+
+	var err error
+	email := map[string]interface{}{}
+	db := map[string]interface{}{}
+	post := map[string]interface{}{}
+	attachment := map[string]interface{}{}
+	config := map[string]interface{}{}
+
+	fmt.Fprintln(out, "SMTP server")
+	if email["host"], err = p.ask("  Host", "", required); err != nil {
+		return err
+	}
+	if email["port"], err = p.askPort("  Port (SSL/TLS)", 465); err != nil {
+		return err
+	}
+	if email["username"], err = p.ask("  Username", "", required); err != nil {
+		return err
+	}
+	if email["password"], err = p.ask("  Password", "", required); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "DM database")
+	if db["host"], err = p.ask("  Host", "127.0.0.1", required); err != nil {
+		return err
+	}
+	if db["port"], err = p.askPort("  Port", 5236); err != nil {
+		return err
+	}
+	if db["username"], err = p.ask("  Username", "SYSDBA", required); err != nil {
+		return err
+	}
+	if db["password"], err = p.ask("  Password", "", required); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Schedule")
+	if config["time"], err = p.ask("  Cron expression (minute hour day month weekday)", "0 8 * * *", func(value string) error {
+		_, err := cron.ParseStandard(value)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "First post")
+	if post["from"], err = p.ask("  From", fmt.Sprint(email["username"]), func(value string) error {
+		_, err := mail.ParseAddress(value)
+		return err
+	}); err != nil {
+		return err
+	}
+	to, err := p.ask("  To (comma-separated)", "", validateAddresses)
+	if err != nil {
+		return err
+	}
+	recipients := make([]string, 0)
+	for _, address := range strings.Split(to, ",") {
+		recipients = append(recipients, strings.TrimSpace(address))
+	}
+	post["to"] = recipients
+	if post["subject"], err = p.ask("  Subject", "Daily report", required); err != nil {
+		return err
+	}
+	if post["body"], err = p.ask("  Body", "Please find the report attached.", nil); err != nil {
+		return err
+	}
+	if attachment["table"], err = p.ask("  Table or view to export", "", required); err != nil {
+		return err
+	}
+	if attachment["excel"], err = p.ask("  Attachment name", "report.xlsx", validateFileName); err != nil {
+		return err
+	}
+
+	post["attachment"] = []interface{}{attachment}
+	config["email"] = email
+	config["db"] = db
+	config["post"] = []interface{}{post}
+
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// Check the result the same way as -validate does
+	var parsed Config
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return err
+	}
+	if issues := validateConfig(&parsed); len(issues) > 0 {
+		return fmt.Errorf("generated config is invalid: %s", strings.Join(issues, "; "))
+	}
+
+	mode, _ := parsed.fileMode()
+	if err := os.WriteFile(configPath, append(data, '\n'), mode); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nWrote %s. See README.md for all options.\n", configPath)
+	return nil
+}
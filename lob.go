@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"dm"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultMaxLOBLength caps LOB cells written to Excel or Google Sheets when
+// max_lob_length is not set. It is the longest text an Excel cell holds.
+const defaultMaxLOBLength = 32767
+
+// lobChunkSize is the number of characters or bytes read from a LOB at a time.
+const lobChunkSize = 64 * 1024
+
+// isLOBColumn reports whether a column holds a large object, which the driver
+// returns as a locator instead of the value itself.
+//
+// @param columnType: column type
+// @return bool: true for LOB columns
+func isLOBColumn(columnType *sql.ColumnType) bool {
+	switch strings.ToUpper(columnType.DatabaseTypeName()) {
+	case "CLOB", "TEXT", "LONGVARCHAR", "BLOB", "IMAGE", "LONGVARBINARY":
+		return true
+	}
+	return false
+}
+
+// maxLOBLength returns the number of characters or bytes read from a LOB cell.
+// Without max_lob_length, cells written to an Excel file or a Google Sheet are
+// capped at the Excel cell limit and the cells of other formats are read whole.
+//
+// @return int: LOB length cap, 0 for none
+func (c TableAttachmentConfig) maxLOBLength() int {
+	if c.MaxLOBLength > 0 {
+		return c.MaxLOBLength
+	}
+	if c.Template != "" || c.GoogleSheet != nil {
+		return defaultMaxLOBLength
+	}
+	for _, format := range c.formats() {
+		if format == formatXLSX {
+			return defaultMaxLOBLength
+		}
+	}
+	return 0
+}
+
+// readLOB reads a LOB value into cell text, streaming it from the database in
+// chunks. Text longer than the cap is truncated with a note giving its length,
+// and the note counts toward the cap so that the whole cell stays within it.
+// Binary values become a placeholder, or base64 when configured and within the cap.
+//
+// @param value: scanned column value
+// @param limit: maximum number of characters or bytes read, 0 for no limit
+// @param mode: binary_columns setting
+// @return []byte: cell text, nil for NULL
+// @return error: error if any
+func readLOB(value interface{}, limit int, mode string) ([]byte, error) {
+	if limit <= 0 {
+		limit = math.MaxInt
+	}
+
+	switch lob := value.(type) {
+	case nil:
+		return nil, nil
+	case *dm.DmClob:
+		if !lob.Valid {
+			return nil, nil
+		}
+		length, err := lob.GetLength()
+		if err != nil {
+			log.Printf("Failed to read CLOB length: %v", err)
+			return nil, err
+		}
+
+		keep, note := truncation(length, limit)
+		var text strings.Builder
+		for pos := int64(1); pos <= length && pos <= keep; {
+			size := int64(lobChunkSize)
+			if remaining := keep - pos + 1; remaining < size {
+				size = remaining
+			}
+			chunk, err := lob.ReadString(int(pos), int(size))
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to read CLOB: %v", err)
+				return nil, err
+			}
+			text.WriteString(chunk)
+			pos += int64(utf8.RuneCountInString(chunk))
+		}
+		text.WriteString(note)
+		return []byte(text.String()), nil
+	case *dm.DmBlob:
+		if !lob.Valid {
+			return nil, nil
+		}
+		length, err := lob.GetLength()
+		if err != nil {
+			log.Printf("Failed to read BLOB length: %v", err)
+			return nil, err
+		}
+		if mode != binaryBase64 || length > int64(limit) {
+			return []byte(fmt.Sprintf("[binary %d bytes]", length)), nil
+		}
+
+		data := make([]byte, 0, length)
+		chunk := make([]byte, lobChunkSize)
+		for int64(len(data)) < length {
+			n, err := lob.Read(chunk)
+			data = append(data, chunk[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to read BLOB: %v", err)
+				return nil, err
+			}
+		}
+		return formatBinary(data, mode), nil
+	case string:
+		if utf8.RuneCountInString(lob) <= limit {
+			return []byte(lob), nil
+		}
+		runes := []rune(lob)
+		keep, note := truncation(int64(len(runes)), limit)
+		return []byte(string(runes[:keep]) + note), nil
+	case []byte:
+		if mode != binaryBase64 || len(lob) > limit {
+			return []byte(fmt.Sprintf("[binary %d bytes]", len(lob))), nil
+		}
+		return formatBinary(lob, mode), nil
+	default:
+		return []byte(fmt.Sprint(lob)), nil
+	}
+}
+
+// truncation returns how many characters of a text are kept within the cap and
+// the note appended to them, which is empty when the text fits. A cap shorter
+// than the note keeps the note alone.
+//
+// @param length: text length in characters
+// @param limit: maximum number of characters of the cell
+// @return int64: number of characters kept
+// @return string: truncation note
+func truncation(length int64, limit int) (int64, string) {
+	if length <= int64(limit) {
+		return length, ""
+	}
+	note := fmt.Sprintf("...[truncated, %d characters]", length)
+	return max(int64(limit)-int64(len(note)), 0), note
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestReadLOBText(t *testing.T) {
+	long := strings.Repeat("报", 40000)
+	tests := []struct {
+		name  string
+		value string
+		limit int
+		want  string
+	}{
+		{"fits", "short text", 10, "short text"},
+		{"no limit", long, 0, long},
+		{"truncated", strings.Repeat("x", 50), 40, strings.Repeat("x", 11) + "...[truncated, 50 characters]"},
+		{"limit shorter than the note", strings.Repeat("x", 50), 5, "...[truncated, 50 characters]"},
+		{"excel cell", long, defaultMaxLOBLength, strings.Repeat("报", defaultMaxLOBLength-32) + "...[truncated, 40000 characters]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readLOB(tt.value, tt.limit, "")
+			if err != nil {
+				t.Fatalf("readLOB: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("readLOB = %q (%d characters), want %d characters", got, utf8.RuneCount(got), utf8.RuneCountInString(tt.want))
+			}
+			if tt.limit >= len("...[truncated, 50 characters]") && utf8.RuneCount(got) > tt.limit {
+				t.Errorf("readLOB returned %d characters, over the cap of %d", utf8.RuneCount(got), tt.limit)
+			}
+		})
+	}
+}
+
+func TestMaxLOBLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		config TableAttachmentConfig
+		want   int
+	}{
+		{"default xlsx", TableAttachmentConfig{}, defaultMaxLOBLength},
+		{"xlsx among formats", TableAttachmentConfig{Formats: []string{formatCSV, formatXLSX}}, defaultMaxLOBLength},
+		{"csv only", TableAttachmentConfig{Formats: []string{formatCSV}}, 0},
+		{"csv to google sheet", TableAttachmentConfig{Formats: []string{formatCSV}, GoogleSheet: &GoogleSheetConfig{}}, defaultMaxLOBLength},
+		{"configured", TableAttachmentConfig{Formats: []string{formatCSV}, MaxLOBLength: 100}, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.maxLOBLength(); got != tt.want {
+				t.Errorf("maxLOBLength() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// quiet suppresses informational logs, keeping only warnings and errors.
+var quiet bool
+
+// dumpMessages logs every rendered message before it is sent. It is only
+// enabled with log_level debug and debug_dump_messages both set.
+var dumpMessages bool
+
+// dumpRedact hides the recipient addresses in dumped messages.
+var dumpRedact = true
+
+// Supported log levels.
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+)
+
+// Supported log timestamp formats, mapped to the flags of the standard logger.
+var logTimestamps = map[string]int{
+	"none":         0,
+	"seconds":      log.LstdFlags,
+	"microseconds": log.LstdFlags | log.Lmicroseconds,
+}
+
+// configureLogger applies the configured prefix and timestamp format to the
+// standard logger. Timestamps default to the date and time in seconds.
+//
+// @param config: configuration
+func configureLogger(config *Config) {
+	flags := log.LstdFlags
+	if value, ok := logTimestamps[config.LogTimestamp]; ok {
+		flags = value
+	}
+	if config.LogUTC {
+		flags |= log.LUTC
+	}
+	if config.LogPrefix != "" {
+		// Keep the timestamp first so log lines still sort by time
+		flags |= log.Lmsgprefix
+		log.SetPrefix(config.LogPrefix)
+	}
+	log.SetFlags(flags)
+}
+
+// logInfof logs an informational message unless quiet mode is enabled.
+//
+// @param format: message format
+// @param args: format arguments
+func logInfof(format string, args ...interface{}) {
+	if !quiet {
+		log.Printf(format, args...)
+	}
+}
+
+// logInfoln logs an informational message unless quiet mode is enabled.
+//
+// @param args: message values
+func logInfoln(args ...interface{}) {
+	if !quiet {
+		log.Println(args...)
+	}
+}
+
+// logMessageDump logs the raw bytes of a message when message dumps are
+// enabled. Recipient addresses are replaced unless redaction is turned off;
+// SMTP credentials are never part of the message.
+//
+// @param message: rendered message
+// @param recipients: recipient addresses
+func logMessageDump(message []byte, recipients []string) {
+	if !dumpMessages || quiet {
+		return
+	}
+
+	dump := string(message)
+	if dumpRedact {
+		for _, recipient := range recipients {
+			dump = strings.ReplaceAll(dump, recipient, "[redacted]")
+		}
+	}
+	log.Printf("DEBUG message dump (%d bytes):\n%s", len(message), dump)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestBuildMessageGolden(t *testing.T) {
+	messageBoundary = "BOUNDARY"
+	defer func() { messageBoundary = "" }()
+
+	csv := "ID,NAME\r\n1,Zoë\r\n2,Ünal\r\n"
+	tests := []struct {
+		name     string
+		email    Email
+		eightBit bool
+	}{
+		{
+			name: "plain",
+			email: Email{
+				From:    "reports@example.com",
+				To:      []string{"a@example.com", "b@example.com"},
+				Subject: "Daily report",
+				Body:    "Hello,\r\n\r\nthe report is attached.",
+				Attachments: []Attachment{
+					{fileName: "report.csv", mimeType: "text/csv; charset=utf-8", file: bytes.NewBufferString(csv)},
+				},
+			},
+		},
+		{
+			name: "8bit",
+			email: Email{
+				From:    "reports@example.com",
+				To:      []string{"a@example.com"},
+				Subject: "Daily report",
+				Body:    "Hello",
+				Headers: priorityHeaderValues("high"),
+				Attachments: []Attachment{
+					{fileName: "report.csv", mimeType: "text/csv; charset=utf-8", file: bytes.NewBufferString(csv), encoding: encoding8Bit},
+				},
+			},
+			eightBit: true,
+		},
+		{
+			name: "quoted-printable",
+			email: Email{
+				From:    "reports@example.com",
+				To:      []string{"a@example.com"},
+				Subject: "Daily report",
+				Body:    "Hello",
+				Attachments: []Attachment{
+					{fileName: "report.csv", mimeType: "text/csv; charset=utf-8", file: bytes.NewBufferString(csv), encoding: encoding8Bit},
+				},
+			},
+		},
+		{
+			name: "markdown-truncated",
+			email: Email{
+				From:          "reports@example.com",
+				To:            []string{"a@example.com"},
+				Subject:       "Daily report",
+				Body:          "# Report\n\nAll **42** rows were exported.",
+				MaxBodyLength: 10,
+				Markdown:      true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := buildMessage(tt.email, tt.eightBit)
+			if err != nil {
+				t.Fatalf("buildMessage: %v", err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".eml")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("message differs from %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestIs8BitText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want bool
+	}{
+		{"empty", "", true},
+		{"crlf lines", "a,b\r\n1,2\r\n", true},
+		{"lf lines", "a,b\n1,2\n", true},
+		{"utf-8", "Zoë,Ünal\r\n", true},
+		{"nul byte", "a\x00b", false},
+		{"bare cr", "a\rb", false},
+		{"trailing cr", "a\r", false},
+		{"998 byte line", strings.Repeat("x", 998) + "\r\n", true},
+		{"999 byte line", strings.Repeat("x", 999) + "\r\n", false},
+		{"long text over lines", strings.Repeat(strings.Repeat("x", 900)+"\n", 3), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := is8BitText([]byte(tt.data)); got != tt.want {
+				t.Errorf("is8BitText(%q) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		mimeType string
+		data     string
+		eightBit bool
+		want     string
+	}{
+		{"default", "", "text/csv", "a,b", true, encodingBase64},
+		{"base64", encodingBase64, "text/csv", "a,b", true, encodingBase64},
+		{"quoted-printable", encodingQuotedPrintable, "application/octet-stream", "a,b", false, encodingQuotedPrintable},
+		{"8bit", encoding8Bit, "text/csv", "a,b", true, encoding8Bit},
+		{"8bit without server support", encoding8Bit, "text/csv", "a,b", false, encodingQuotedPrintable},
+		{"8bit with binary text", encoding8Bit, "text/csv", "a\x00b", true, encodingQuotedPrintable},
+		{"8bit binary file", encoding8Bit, "application/zip", "PK\x03\x04\x00", true, encodingBase64},
+		{"8bit binary without server support", encoding8Bit, "application/zip", "PK", false, encodingBase64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachment := Attachment{mimeType: tt.mimeType, file: bytes.NewBufferString(tt.data), encoding: tt.encoding}
+			if got := attachment.transferEncoding(tt.eightBit); got != tt.want {
+				t.Errorf("transferEncoding(%v) = %q, want %q", tt.eightBit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteAttachmentEncoding(t *testing.T) {
+	binary := string([]byte{0x00, 0xff, '\r', '\n', 0x80, '=', ' '})
+	tests := []struct {
+		name     string
+		encoding string
+		mimeType string
+		data     string
+	}{
+		{"base64 text", encodingBase64, "text/csv", "ID,NAME\r\n1,Zoë\r\n"},
+		{"base64 binary", encodingBase64, "application/octet-stream", binary},
+		{"quoted-printable text", encodingQuotedPrintable, "text/csv", "ID,NAME\r\n1,Zoë\r\n" + strings.Repeat("x", 200) + "\r\n"},
+		{"quoted-printable binary", encodingQuotedPrintable, "application/octet-stream", binary},
+		{"8bit", encoding8Bit, "text/csv", "ID,NAME\r\n1,Zoë\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer := multipart.NewWriter(&buf)
+			if err := writeAttachment(writer, bytes.NewBufferString(tt.data), "data", tt.mimeType, tt.encoding); err != nil {
+				t.Fatalf("writeAttachment: %v", err)
+			}
+			writer.Close()
+
+			part, err := multipart.NewReader(&buf, writer.Boundary()).NextRawPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := part.Header.Get("Content-Transfer-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Transfer-Encoding = %q, want %q", got, tt.encoding)
+			}
+			var decoder io.Reader = part
+			switch tt.encoding {
+			case encodingBase64:
+				decoder = base64.NewDecoder(base64.StdEncoding, part)
+			case encodingQuotedPrintable:
+				decoder = quotedprintable.NewReader(part)
+			}
+			got, err := io.ReadAll(decoder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.data {
+				t.Errorf("decoded %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
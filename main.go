@@ -2,23 +2,46 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"database/sql"
-	_ "dm"
+	"database/sql/driver"
+	"dm"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode/utf8"
 
 	"github.com/robfig/cron/v3"
 	"github.com/xuri/excelize/v2"
+	"github.com/yuin/goldmark"
 )
 
 /**
@@ -60,431 +83,4095 @@ type Attachment struct {
 	fileName string
 	mimeType string
 	file     *bytes.Buffer
+	encoding string
+	// rows is the number of data rows exported into the file, if it holds query results
+	rows int
+	// result holds the rows of a table export, reused by the combined workbook;
+	// paged exports only keep their first row
+	result *ResultSet
+}
+
+// Attachment transfer encodings.
+const (
+	encodingBase64          = "base64"
+	encodingQuotedPrintable = "quoted-printable"
+	encoding8Bit            = "8bit"
+)
+
+// transferEncoding returns the Content-Transfer-Encoding used for the attachment.
+// 8bit is only used when the server supports 8BITMIME and the content is valid
+// 8bit text; otherwise text falls back to quoted-printable and binary data to base64.
+//
+// @param eightBit: whether the server advertises 8BITMIME
+// @return string: transfer encoding
+func (a Attachment) transferEncoding(eightBit bool) string {
+	switch a.encoding {
+	case encodingQuotedPrintable:
+		return encodingQuotedPrintable
+	case encoding8Bit:
+		if eightBit && is8BitText(a.file.Bytes()) {
+			return encoding8Bit
+		}
+		if strings.HasPrefix(a.mimeType, "text/") {
+			return encodingQuotedPrintable
+		}
+	}
+	return encodingBase64
+}
+
+// is8BitText reports whether data can be sent with 8bit transfer encoding:
+// no NUL bytes, no bare CR and no line longer than 998 bytes.
+//
+// @param data: attachment data
+// @return bool: true if the data is valid 8bit text
+func is8BitText(data []byte) bool {
+	lineLength := 0
+	for i, b := range data {
+		switch b {
+		case 0:
+			return false
+		case '\r':
+			if i+1 >= len(data) || data[i+1] != '\n' {
+				return false
+			}
+			// The line break does not count towards the line length
+			continue
+		case '\n':
+			lineLength = 0
+			continue
+		}
+		if lineLength++; lineLength > 998 {
+			return false
+		}
+	}
+	return true
 }
 
 // Config represents the configuration of the application.
 type Config struct {
-	Email EmailConfig  `json:"email"`
-	DB    DBConfig     `json:"db"`
-	Post  []PostConfig `json:"post"`
-	Time  string       `json:"time"`
+	Email              EmailConfig            `json:"email"`
+	DB                 DBConfig               `json:"db"`
+	Post               []PostConfig           `json:"post"`
+	Time               string                 `json:"time"`
+	Heartbeat          *HeartbeatConfig       `json:"heartbeat_email"`
+	StateFile          string                 `json:"state_file"`
+	PostConcurrency    int                    `json:"post_concurrency"`
+	SubjectPrefix      string                 `json:"subject_prefix"`
+	SubjectSuffix      string                 `json:"subject_suffix"`
+	AttachmentEncoding string                 `json:"attachment_encoding"`
+	Retries            int                    `json:"retries"`
+	RetryDelaySeconds  int                    `json:"retry_delay_seconds"`
+	MaxBodyLength      int                    `json:"max_body_length"`
+	GzipBodyAttachment bool                   `json:"gzip_body_attachment"`
+	FileMode           string                 `json:"file_mode"`
+	AdminEmail         *AdminEmailConfig      `json:"admin_email"`
+	SMTPFailureLimit   int                    `json:"smtp_failure_threshold"`
+	EmailProfiles      map[string]EmailConfig `json:"email_profiles"`
+	LogLevel           string                 `json:"log_level"`
+	Upload             *UploadConfig          `json:"upload"`
+	PostDelaySeconds   int                    `json:"post_delay_seconds"`
+	Databases          map[string]DBConfig    `json:"databases"`
+	DebugDumpMessages  bool                   `json:"debug_dump_messages"`
+	DebugDumpRedact    *bool                  `json:"debug_dump_redact"`
+	LazyDBConnect      bool                   `json:"lazy_db_connect"`
+	DBConnectRetries   int                    `json:"db_connect_retries"`
+	DBRetryDelay       int                    `json:"db_connect_retry_delay_seconds"`
+	RejectedRetries    int                    `json:"rejected_recipient_retries"`
+	RejectedRetryDelay int                    `json:"rejected_recipient_retry_delay_seconds"`
+	CronFormat         string                 `json:"cron_format"`
+	SummaryPDF         string                 `json:"summary_pdf"`
+	QueryTimeout       int                    `json:"query_timeout_seconds"`
+	MaxSMTPConnections int                    `json:"max_smtp_connections"`
+	PostRunCommand     string                 `json:"post_run_command"`
+	PostRunTimeout     int                    `json:"post_run_command_timeout_seconds"`
+	MaxLOBLength       int                    `json:"max_lob_length"`
+	FailureThreshold   string                 `json:"failure_threshold"`
+	DefaultFormats     []string               `json:"default_formats"`
+	LogPrefix          string                 `json:"log_prefix"`
+	LogTimestamp       string                 `json:"log_timestamp"`
+	LogUTC             bool                   `json:"log_utc"`
+	FileDateFormat     string                 `json:"file_date_format"`
+	MaxRunSeconds      int                    `json:"max_run_seconds"`
+	StartupSelfTest    bool                   `json:"startup_selftest"`
+	SelfTestStrict     bool                   `json:"startup_selftest_strict"`
+}
+
+// Supported cron expression formats: the standard five crontab fields, or six
+// fields starting with seconds.
+const (
+	cronFormatStandard    = "standard"
+	cronFormatWithSeconds = "with_seconds"
+)
+
+// cronParser returns the parser of the configured cron format, defaulting to
+// the standard five fields.
+//
+// @return cron.Parser: cron expression parser
+func (c Config) cronParser() cron.Parser {
+	fields := cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor
+	if c.CronFormat == cronFormatWithSeconds {
+		fields |= cron.Second
+	}
+	return cron.NewParser(fields)
+}
+
+// scheduleEnv names the environment variable that, when set, overrides the
+// "time" option.
+const scheduleEnv = "DMMAILER_SCHEDULE"
+
+// applyScheduleOverride replaces the cron expression of the "time" option with
+// the value of DMMAILER_SCHEDULE when it is set.
+//
+// @param config: configuration
+func applyScheduleOverride(config *Config) {
+	schedule := strings.TrimSpace(os.Getenv(scheduleEnv))
+	if schedule == "" {
+		return
+	}
+	logInfof("Schedule overridden by %s: %q (config file: %q)", scheduleEnv, schedule, config.Time)
+	config.Time = schedule
+}
+
+// parseSchedule parses the cron expression of the "time" option. When the
+// number of fields matches the other format, the error says so.
+//
+// @return cron.Schedule: schedule
+// @return error: error if the expression is invalid
+func (c Config) parseSchedule() (cron.Schedule, error) {
+	schedule, err := c.cronParser().Parse(c.Time)
+	if err == nil {
+		return schedule, nil
+	}
+
+	fields := len(strings.Fields(c.Time))
+	if c.CronFormat == cronFormatWithSeconds && fields == 5 {
+		return nil, fmt.Errorf("%w; cron_format with_seconds expects 6 fields starting with seconds, this looks like a standard 5-field expression", err)
+	}
+	if c.CronFormat != cronFormatWithSeconds && fields == 6 {
+		return nil, fmt.Errorf("%w; the standard cron format expects 5 fields, set cron_format to with_seconds for a 6-field expression with seconds", err)
+	}
+	return nil, err
+}
+
+// postSubject returns the subject of a post with the global prefix and suffix
+// applied, separated from it by a space.
+//
+// @param post: post configuration
+// @return string: email subject
+func (c Config) postSubject(post PostConfig) string {
+	parts := make([]string, 0, 3)
+	for _, part := range []string{c.SubjectPrefix, post.Subject, c.SubjectSuffix} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// postServers returns the SMTP servers a post is sent through: those of its
+// email profile, or the default email configuration when it names none.
+//
+// @param post: post configuration
+// @return []SMTPServerConfig: SMTP servers in the order they are tried
+func (c Config) postServers(post PostConfig) []SMTPServerConfig {
+	return c.postEmail(post).smtpServers()
+}
+
+// postEmail returns the email configuration a post is sent with: its email
+// profile, or the default email configuration when it names none.
+//
+// @param post: post configuration
+// @return EmailConfig: email configuration
+func (c Config) postEmail(post PostConfig) EmailConfig {
+	if profile, ok := c.EmailProfiles[post.EmailProfile]; ok && post.EmailProfile != "" {
+		return profile
+	}
+	return c.Email
+}
+
+// fileMode returns the permissions of the files written by the program, given
+// in octal such as "0640". It defaults to 0600.
+//
+// @return os.FileMode: file permissions
+// @return error: error if the mode is invalid
+func (c Config) fileMode() (os.FileMode, error) {
+	if c.FileMode == "" {
+		return defaultFileMode, nil
+	}
+
+	mode, err := strconv.ParseUint(c.FileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %q", c.FileMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// failureThreshold returns the number of failed posts a run tolerates, given
+// as a count such as "2" or as a percentage of the posts run such as "10%".
+// It defaults to 0, so that any failed post fails the run.
+//
+// @param total: number of posts run
+// @return float64: number of failed posts tolerated
+// @return error: error if the threshold is invalid
+func (c Config) failureThreshold(total int) (float64, error) {
+	threshold := strings.TrimSpace(c.FailureThreshold)
+	if threshold == "" {
+		return 0, nil
+	}
+
+	if percent, ok := strings.CutSuffix(threshold, "%"); ok {
+		value, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || value < 0 || value > 100 {
+			return 0, fmt.Errorf("invalid failure threshold %q", c.FailureThreshold)
+		}
+		return value / 100 * float64(total), nil
+	}
+
+	value, err := strconv.Atoi(threshold)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid failure threshold %q", c.FailureThreshold)
+	}
+	return float64(value), nil
+}
+
+// dateStyles maps the named file_date_format styles to Go layouts. File names cannot
+// contain slashes, so every style separates the date parts with dashes.
+var dateStyles = map[string]string{
+	"ISO": "2006-01-02",
+	"US":  "01-02-2006",
+	"EU":  "02-01-2006",
+}
+
+// dateLayout returns the layout of {{.date}} in file name templates: a named
+// style, or a Go reference layout such as "20060102". It defaults to ISO.
+//
+// @return string: Go time layout
+// @return error: error if the layout does not give the year, month and day
+func (c Config) dateLayout() (string, error) {
+	if c.FileDateFormat == "" {
+		return dateStyles["ISO"], nil
+	}
+	if layout, ok := dateStyles[strings.ToUpper(c.FileDateFormat)]; ok {
+		return layout, nil
+	}
+
+	// The layout must render a date that parses back to the same day
+	sample := time.Date(2023, time.November, 25, 0, 0, 0, 0, time.UTC)
+	parsed, err := time.Parse(c.FileDateFormat, sample.Format(c.FileDateFormat))
+	if err != nil || !parsed.Equal(sample) {
+		return "", fmt.Errorf("invalid date format %q, use ISO, US, EU or a Go layout with year, month and day", c.FileDateFormat)
+	}
+	return c.FileDateFormat, nil
+}
+
+// HeartbeatConfig represents the heartbeat email configuration.
+type HeartbeatConfig struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+}
+
+// AdminEmailConfig represents the administrator notified when a run fails after
+// all retries and, with summary set, after every successful run.
+type AdminEmailConfig struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Summary bool   `json:"summary"`
+	// SummaryPDF attaches the PDF run report to the administrator emails
+	SummaryPDF bool `json:"summary_pdf"`
 }
 
 // EmailConfig represents the email configuration.
 type EmailConfig struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Host         string             `json:"host"`
+	Port         int                `json:"port"`
+	Username     string             `json:"username"`
+	Password     string             `json:"password"`
+	PasswordFile string             `json:"password_file"`
+	Servers      []SMTPServerConfig `json:"servers"`
+	Timeout      int                `json:"smtp_timeout_seconds"`
+	Plain        bool               `json:"plain"`
+	TLSMode      string             `json:"tls_mode"`
+	Bounce       string             `json:"bounce_address"`
+}
+
+// SMTPServerConfig represents a fallback SMTP server configuration.
+type SMTPServerConfig struct {
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
+	Timeout      int    `json:"smtp_timeout_seconds"`
+	// Plain connects without TLS or authentication, for local test servers only
+	Plain   bool   `json:"plain"`
+	TLSMode string `json:"tls_mode"`
+}
+
+// SMTP TLS modes: implicit TLS from the start of the connection (usually port
+// 465), or a plain connection upgraded with STARTTLS (usually ports 25 and 587).
+const (
+	tlsModeImplicit = "tls"
+	tlsModeStartTLS = "starttls"
+)
+
+// defaultSMTPTimeout is the SMTP timeout used when none is configured.
+const defaultSMTPTimeout = 60 * time.Second
+
+// timeout returns the deadline applied to each SMTP protocol phase.
+//
+// @return time.Duration: SMTP timeout
+func (c SMTPServerConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultSMTPTimeout
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// smtpServers returns the SMTP servers to try in order: the primary server
+// first (if configured), followed by the fallback servers. Fallback servers
+// without their own timeout inherit the primary one.
+//
+// @return []SMTPServerConfig: SMTP servers
+func (c EmailConfig) smtpServers() []SMTPServerConfig {
+	servers := make([]SMTPServerConfig, 0, len(c.Servers)+1)
+	if c.Host != "" {
+		servers = append(servers, SMTPServerConfig{
+			Host:     c.Host,
+			Port:     c.Port,
+			Username: c.Username,
+			Password: c.Password,
+			Timeout:  c.Timeout,
+			Plain:    c.Plain,
+			TLSMode:  c.TLSMode,
+		})
+	}
+	for _, server := range c.Servers {
+		if server.Timeout == 0 {
+			server.Timeout = c.Timeout
+		}
+		servers = append(servers, server)
+	}
+	return servers
 }
 
 // DBConfig represents the database configuration.
 type DBConfig struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
+	SSL          bool   `json:"ssl"`
+	SSLCertPath  string `json:"ssl_cert_path"`
+	SSLKeyPath   string `json:"ssl_key_path"`
+}
+
+// dsnParams returns the DSN parameters of the database connection. With ssl
+// enabled, the DM driver connects over TLS using the client certificate and key.
+//
+// @return url.Values: DSN parameters
+func (c DBConfig) dsnParams() url.Values {
+	params := url.Values{}
+	if c.SSL {
+		params.Set("sslCertPath", c.SSLCertPath)
+		params.Set("sslKeyPath", c.SSLKeyPath)
+	}
+	return params
 }
 
 // PostConfig represents the email post configuration.
 type PostConfig struct {
-	From       string                  `json:"from"`
-	To         []string                `json:"to"`
-	Subject    string                  `json:"subject"`
-	Body       string                  `json:"body"`
-	Attachment []TableAttachmentConfig `json:"attachment"`
+	ID                   string                  `json:"id"`
+	From                 string                  `json:"from"`
+	To                   []string                `json:"to"`
+	Subject              string                  `json:"subject"`
+	Body                 string                  `json:"body"`
+	Attachment           []TableAttachmentConfig `json:"attachment"`
+	RecipientsQuery      string                  `json:"recipients_query"`
+	SkipWeekends         bool                    `json:"skip_weekends"`
+	Holidays             []string                `json:"holidays"`
+	Priority             string                  `json:"priority"`
+	BodyType             string                  `json:"body_type"`
+	EmailProfile         string                  `json:"email_profile"`
+	ConsistentSnapshot   bool                    `json:"consistent_snapshot"`
+	RecipientAttachments map[string][]string     `json:"recipient_attachments"`
+	Enabled              *bool                   `json:"enabled"`
+	CSVZip               string                  `json:"csv_zip"`
+	RecipientsFile       string                  `json:"recipients_file"`
+	RecipientsColumn     string                  `json:"recipients_file_column"`
+	DefaultFormats       []string                `json:"default_formats"`
+	Checksums            bool                    `json:"checksums"`
+	ChecksumHeader       bool                    `json:"checksum_header"`
+	CombinedWorkbook     string                  `json:"combined_workbook"`
+}
+
+// Supported post body types.
+const (
+	bodyTypeText     = "text"
+	bodyTypeMarkdown = "markdown"
+)
+
+// holidayLayout is the date layout of configured holidays.
+const holidayLayout = "2006-01-02"
+
+// postKey returns the stable identifier of a post, which keys its state kept
+// between runs: its id, or else its subject. Posts without an id that share a
+// subject are told apart by their order among those posts, so that inserting
+// or reordering other posts does not change the key.
+//
+// @param index: position of the post in the configuration
+// @return string: post identifier
+func (c Config) postKey(index int) string {
+	post := c.Post[index]
+	if post.ID != "" {
+		return post.ID
+	}
+	occurrence := 1
+	for _, other := range c.Post[:index] {
+		if other.ID == "" && other.Subject == post.Subject {
+			occurrence++
+		}
+	}
+	if occurrence == 1 {
+		return post.Subject
+	}
+	return fmt.Sprintf("%s #%d", post.Subject, occurrence)
+}
+
+// enabled reports whether the post is enabled. Posts are enabled unless
+// "enabled" is set to false.
+//
+// @return bool: true if the post is enabled
+func (p PostConfig) enabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// orderedAttachments returns the attachments of the post sorted by their
+// "order" field. Attachments with the same order keep their declared order.
+// With csv_zip set, they are exported as CSV only.
+//
+// @return []TableAttachmentConfig: attachments in email order
+func (p PostConfig) orderedAttachments() []TableAttachmentConfig {
+	attachments := append([]TableAttachmentConfig{}, p.Attachment...)
+	if p.CSVZip != "" {
+		for i := range attachments {
+			attachments[i].Formats = []string{formatCSV}
+		}
+	}
+	sort.SliceStable(attachments, func(i, j int) bool {
+		return attachments[i].Order < attachments[j].Order
+	})
+	return attachments
+}
+
+// attachmentsFor returns the attachments sent to a recipient. Recipients listed
+// in recipient_attachments only receive the named files; others receive all
+// attachments. Addresses are matched case-insensitively.
+//
+// @param recipient: recipient address
+// @param attachments: all attachments of the post
+// @return []Attachment: attachments for the recipient
+func (p PostConfig) attachmentsFor(recipient string, attachments []Attachment) []Attachment {
+	for address, fileNames := range p.RecipientAttachments {
+		if !strings.EqualFold(address, recipient) {
+			continue
+		}
+
+		selected := make([]Attachment, 0, len(fileNames))
+		for _, attachment := range attachments {
+			for _, fileName := range fileNames {
+				if attachment.fileName == fileName {
+					selected = append(selected, attachment)
+					break
+				}
+			}
+		}
+		return selected
+	}
+	return attachments
+}
+
+// skipReason returns why the post should not be sent on the given day, or an
+// empty string if it should be sent.
+//
+// @param now: current time
+// @return string: reason for skipping the post
+func (p PostConfig) skipReason(now time.Time) string {
+	if p.SkipWeekends && (now.Weekday() == time.Saturday || now.Weekday() == time.Sunday) {
+		return fmt.Sprintf("%s is a weekend day", now.Weekday())
+	}
+
+	today := now.Format(holidayLayout)
+	for _, holiday := range p.Holidays {
+		if holiday == today {
+			return fmt.Sprintf("%s is a holiday", today)
+		}
+	}
+	return ""
 }
 
 // TableAttachmentConfig represents the table attachment configuration.
 type TableAttachmentConfig struct {
-	Table string `json:"table"`
-	Excel string `json:"excel"`
+	Table          string                       `json:"table"`
+	Excel          string                       `json:"excel"`
+	ExcludeColumns []string                     `json:"exclude_columns"`
+	Template       string                       `json:"template"`
+	Cells          map[string]string            `json:"cells"`
+	SendIfChanged  bool                         `json:"send_if_changed"`
+	Title          string                       `json:"title"`
+	StartRow       int                          `json:"start_row"`
+	Formats        []string                     `json:"formats"`
+	File           string                       `json:"file"`
+	MimeType       string                       `json:"mime_type"`
+	ValueMap       map[string]map[string]string `json:"value_map"`
+	Totals         []string                     `json:"totals"`
+	Conditional    []ConditionalFormatConfig    `json:"conditional_formats"`
+	AttachQuery    bool                         `json:"attach_query"`
+	SplitBy        string                       `json:"split_by"`
+	Encoding       string                       `json:"encoding"`
+	Chart          *ChartConfig                 `json:"chart"`
+	DateFormat     string                       `json:"date_format"`
+	MaxSheets      int                          `json:"max_sheets"`
+	OrderBy        []string                     `json:"order_by"`
+	Limit          int                          `json:"limit"`
+	Queries        []QueryConfig                `json:"queries"`
+	BinaryColumns  string                       `json:"binary_columns"`
+	CSVDelimiter   string                       `json:"csv_delimiter"`
+	CSVQuoteAll    bool                         `json:"csv_quote_all"`
+	CSVBOM         bool                         `json:"csv_bom"`
+	Descriptions   map[string]string            `json:"descriptions"`
+	PageSize       int                          `json:"page_size"`
+	Order          int                          `json:"order"`
+	Styles         *SheetStylesConfig           `json:"styles"`
+	Database       string                       `json:"database"`
+	GoogleSheet    *GoogleSheetConfig           `json:"google_sheet"`
+	ExportRetries  int                          `json:"export_retries"`
+	SchemaOnly     bool                         `json:"schema_only"`
+	GroupBy        []string                     `json:"group_by"`
+	Aggregate      []AggregateConfig            `json:"aggregate"`
+	QueryTimeout   int                          `json:"query_timeout_seconds"`
+	Print          *PrintConfig                 `json:"print"`
+	MaxLOBLength   int                          `json:"max_lob_length"`
+	Refresh        bool                         `json:"refresh"`
+	AddRowNumbers  bool                         `json:"add_row_numbers"`
+	Mask           map[string]string            `json:"mask"`
+	UnionTables    []string                     `json:"union_tables"`
+	SourceColumn   string                       `json:"source_column"`
+	TransformCmd   []string                     `json:"transform_command"`
+	TransformExt   string                       `json:"transform_extension"`
+	TransformWait  int                          `json:"transform_timeout_seconds"`
+	ColumnTypes    map[string]string            `json:"column_types"`
 }
 
-// writeBody writes the email body to the multipart writer.
+// PrintConfig represents the print layout of exported sheets. Header and Footer
+// use Excel header/footer codes, such as &P for the page number.
+type PrintConfig struct {
+	Header      string `json:"header"`
+	Footer      string `json:"footer"`
+	Orientation string `json:"orientation"`
+}
+
+// queryContext returns the context of a single query of the attachment, which
+// is cancelled with the run, or after query_timeout_seconds when set.
 //
-// @param writer: multipart writer
-// @param body: email body
+// @param ctx: run context
+// @return context.Context: query context
+// @return context.CancelFunc: releases the context once the query is read
+func (c TableAttachmentConfig) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(c.QueryTimeout)*time.Second)
+}
+
+// AggregateConfig represents an aggregate column of a grouped table export,
+// such as the sum of a value column. Column may be "*" for count.
+type AggregateConfig struct {
+	Function string `json:"function"`
+	Column   string `json:"column"`
+	Alias    string `json:"alias"`
+}
+
+// aggregateFunctions lists the supported aggregate functions.
+var aggregateFunctions = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"count": true,
+	"min":   true,
+	"max":   true,
+}
+
+// alias returns the result column name of the aggregate, by default the
+// function and column joined by an underscore, e.g. SUM_AMOUNT or COUNT_ALL.
+//
+// @return string: result column name
+func (a AggregateConfig) alias() string {
+	if a.Alias != "" {
+		return a.Alias
+	}
+	column := a.Column
+	if column == "*" {
+		column = "ALL"
+	}
+	return strings.ToUpper(a.Function + "_" + column)
+}
+
+// QueryConfig represents one query whose result is stacked into a shared sheet,
+// optionally preceded by a label row.
+type QueryConfig struct {
+	Label string `json:"label"`
+	Query string `json:"query"`
+}
+
+// defaultMaxSheets caps the number of sheets created by split_by when max_sheets is not set.
+const defaultMaxSheets = 50
+
+// ConditionalFormatConfig represents a conditional formatting rule applied to the
+// data range of a column. Rule is either a preset (negative_red, positive_green,
+// color_scale, data_bar) or "cell" for a custom value comparison.
+type ConditionalFormatConfig struct {
+	Column    string `json:"column"`
+	Rule      string `json:"rule"`
+	Criteria  string `json:"criteria"`
+	Value     string `json:"value"`
+	FontColor string `json:"font_color"`
+	FillColor string `json:"fill_color"`
+}
+
+// ChartConfig represents a chart drawn from the exported data, with one series
+// per value column plotted against the category column.
+type ChartConfig struct {
+	Type     string   `json:"type"`
+	Category string   `json:"category"`
+	Values   []string `json:"values"`
+	Title    string   `json:"title"`
+}
+
+// chartTypes maps the supported chart type names to excelize chart types.
+var chartTypes = map[string]excelize.ChartType{
+	"bar":    excelize.Bar,
+	"column": excelize.Col,
+	"line":   excelize.Line,
+	"area":   excelize.Area,
+	"pie":    excelize.Pie,
+}
+
+// Conditional formatting rules.
+const (
+	ruleNegativeRed   = "negative_red"
+	rulePositiveGreen = "positive_green"
+	ruleColorScale    = "color_scale"
+	ruleDataBar       = "data_bar"
+	ruleCell          = "cell"
+)
+
+// Ways of exporting binary columns.
+const (
+	binaryPlaceholder = "placeholder"
+	binaryBase64      = "base64"
+	binaryOmit        = "omit"
+)
+
+// Supported attachment formats.
+const (
+	formatXLSX = "xlsx"
+	formatCSV  = "csv"
+)
+
+// formats returns the attachment formats, defaulting to xlsx.
+//
+// @return []string: attachment formats
+func (c TableAttachmentConfig) formats() []string {
+	if len(c.Formats) == 0 {
+		return []string{formatXLSX}
+	}
+	return c.Formats
+}
+
+// fileName returns the attachment file name for the given format. The configured
+// name is used as-is for a single xlsx attachment; otherwise its extension is
+// replaced by the format.
+//
+// @param format: attachment format
+// @return string: attachment file name
+func (c TableAttachmentConfig) fileName(format string) string {
+	if len(c.Formats) == 0 || (len(c.Formats) == 1 && format == formatXLSX) {
+		return c.Excel
+	}
+	return strings.TrimSuffix(c.Excel, path.Ext(c.Excel)) + "." + format
+}
+
+// queryFileName returns the name of the attached .sql file, matching the base
+// name of the data file.
+//
+// @return string: query file name
+func (c TableAttachmentConfig) queryFileName() string {
+	return sqlFileName(c.Excel)
+}
+
+// sqlFileName replaces the extension of a file name with .sql.
+//
+// @param fileName: data file name
+// @return string: query file name
+func sqlFileName(fileName string) string {
+	return strings.TrimSuffix(fileName, path.Ext(fileName)) + ".sql"
+}
+
+// resolveFileName expands a file name template such as "report_{{.region}}.xlsx".
+// The template can use the current date as {{.date}} (YYYY-MM-DD) and the values
+// of the first row, keyed by lower-case column name; a column named DATE does not
+// replace {{.date}}. When there are no rows, the columns are empty, so that an
+// empty export is still sent. Characters that are not allowed in attachment
+// names are replaced by underscores.
+//
+// @param fileName: file name template
+// @param result: exported rows
+// @return string: resolved file name
 // @return error: error if any
-func writeBody(writer *multipart.Writer, body string) error {
-	log.Println("Writing email body...")
+func resolveFileName(fileName string, result *ResultSet) (string, error) {
+	if !strings.Contains(fileName, "{{") {
+		return fileName, nil
+	}
 
-	// Create a new MIME part for the email body
-	part, err := writer.CreatePart(textproto.MIMEHeader{
-		"Content-Type":              {"text/plain; charset=utf-8"},
-		"Content-Transfer-Encoding": {"quoted-printable"},
-	})
+	data := map[string]string{"date": time.Now().Format(fileDateLayout)}
+	for i, colName := range result.Columns {
+		if key := strings.ToLower(colName); key != "date" {
+			// Without rows, the columns resolve to empty values
+			data[key] = ""
+			if len(result.Rows) > 0 {
+				data[key] = string(result.Rows[0][i])
+			}
+		}
+	}
+	return expandFileName(fileName, data)
+}
+
+// fileDateLayout is the layout of {{.date}} in file name templates, set from
+// file_date_format at startup.
+var fileDateLayout = "2006-01-02"
+
+// expandFileName executes a file name template with the given values and
+// replaces the characters that are not allowed in attachment names.
+//
+// @param fileName: file name template
+// @param data: template values
+// @return string: resolved file name
+// @return error: error if any
+func expandFileName(fileName string, data map[string]string) (string, error) {
+	tmpl, err := template.New("file name").Option("missingkey=error").Parse(fileName)
 	if err != nil {
-		log.Printf("Failed to create MIME part for email body: %v", err)
-		return err
+		return "", err
+	}
+	var resolved strings.Builder
+	if err := tmpl.Execute(&resolved, data); err != nil {
+		return "", err
 	}
 
-	// Create a new quoted-printable writer
-	qp := quotedprintable.NewWriter(part)
-	defer qp.Close() // Ensure qp is closed on function return
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, resolved.String()), nil
+}
 
-	// Write the email body to the part
-	if _, err = qp.Write([]byte(body)); err != nil {
-		log.Printf("Failed to write email body: %v", err)
-		return err
+// fileNames returns the names of all attachments produced by this configuration.
+//
+// @return []string: attachment file names
+func (c TableAttachmentConfig) fileNames() []string {
+	if c.File != "" {
+		if c.Excel != "" {
+			return []string{c.Excel}
+		}
+		return []string{filepath.Base(c.File)}
 	}
 
-	log.Println("Email body written successfully.")
-	return nil
+	var fileNames []string
+	if c.Template != "" || len(c.Queries) > 0 || c.SchemaOnly {
+		fileNames = []string{c.Excel}
+	} else {
+		for _, format := range c.formats() {
+			fileNames = append(fileNames, c.fileName(format))
+		}
+	}
+
+	if c.AttachQuery {
+		fileNames = append(fileNames, c.queryFileName())
+	}
+	return fileNames
 }
 
-// writeAttachment writes the attachment to the multipart writer.
+// queryText returns the SQL that produces the attachment data. Template
+// attachments list each cell query preceded by a comment naming its cell, and
+// stacked queries are listed in order preceded by their labels.
+//
+// @return string: SQL text
+func (c TableAttachmentConfig) queryText() string {
+	if len(c.Queries) > 0 {
+		var text strings.Builder
+		for _, query := range c.Queries {
+			if query.Label != "" {
+				fmt.Fprintf(&text, "-- %s\n", query.Label)
+			}
+			fmt.Fprintf(&text, "%s;\n\n", query.Query)
+		}
+		return text.String()
+	}
+	if c.SchemaOnly {
+		return tableSchemaQuery(c) + ";\n"
+	}
+	if c.Template == "" {
+		return tableQuery(c) + ";\n"
+	}
+
+	refs := make([]string, 0, len(c.Cells))
+	for ref := range c.Cells {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	var text strings.Builder
+	for _, ref := range refs {
+		fmt.Fprintf(&text, "-- %s\n%s;\n\n", ref, c.Cells[ref])
+	}
+	return text.String()
+}
+
+// headerRow returns the row the column header is written to. Without an explicit
+// start row, the header goes to the first row, or to the third row when a title
+// is written in A1 so that a blank row separates them.
+//
+// @return int: header row number
+func (c TableAttachmentConfig) headerRow() int {
+	if c.StartRow > 1 {
+		return c.StartRow
+	}
+	if c.Title != "" {
+		return 3
+	}
+	return 1
+}
+
+// bodyFileName is the base name of the attachment holding the full body when
+// the body is truncated.
+const bodyFileName = "body"
+
+// writeBody writes the email body to the multipart writer. Bodies longer than
+// maxLength characters are truncated with an ellipsis and a note; a maxLength
+// of 0 disables truncation. Markdown bodies are sent as a multipart/alternative
+// part holding the Markdown source as plain text and its HTML rendering.
 //
 // @param writer: multipart writer
-// @param attachment: attachment buffer
-// @param fileName: attachment file name
-// @param mimeType: attachment MIME type
+// @param body: email body
+// @param maxLength: maximum body length in characters
+// @param markdown: whether the body is Markdown
+// @return bool: true if the body was truncated
 // @return error: error if any
-func writeAttachment(writer *multipart.Writer, attachment *bytes.Buffer, fileName, mimeType string) error {
-	log.Printf("Writing email attachment: %s...", fileName)
+func writeBody(writer *multipart.Writer, body string, maxLength int, markdown bool) (bool, error) {
+	logInfoln("Writing email body...")
+
+	truncated := false
+	if runes := []rune(body); maxLength > 0 && len(runes) > maxLength {
+		body = string(runes[:maxLength]) + fmt.Sprintf("...\r\n\r\n(The body was truncated to %d characters. The full content is attached.)", maxLength)
+		truncated = true
+	}
+
+	if !markdown {
+		if err := writeTextPart(writer, "text/plain; charset=utf-8", body); err != nil {
+			return false, err
+		}
+		logInfoln("Email body written successfully.")
+		return truncated, nil
+	}
+
+	html, err := renderMarkdown(body)
+	if err != nil {
+		return false, err
+	}
+
+	var alternativeBuf bytes.Buffer
+	alternative := multipart.NewWriter(&alternativeBuf)
+	if messageBoundary != "" {
+		if err := alternative.SetBoundary(messageBoundary + "-alt"); err != nil {
+			log.Printf("Failed to set MIME boundary: %v", err)
+			return false, err
+		}
+	}
+
+	// The last part is the preferred one, so the HTML rendering follows the plain text
+	if err := writeTextPart(alternative, "text/plain; charset=utf-8", body); err != nil {
+		return false, err
+	}
+	if err := writeTextPart(alternative, "text/html; charset=utf-8", html); err != nil {
+		return false, err
+	}
+	if err := alternative.Close(); err != nil {
+		log.Printf("Failed to finalize email body: %v", err)
+		return false, err
+	}
 
 	part, err := writer.CreatePart(textproto.MIMEHeader{
-		"Content-Type":              {mimeType},
-		"Content-Transfer-Encoding": {"base64"},
-		"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, fileName)},
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%s", alternative.Boundary())},
 	})
 	if err != nil {
-		log.Printf("Failed to create MIME part for attachment: %v", err)
-		return err
+		log.Printf("Failed to create MIME part for email body: %v", err)
+		return false, err
+	}
+	if _, err := part.Write(alternativeBuf.Bytes()); err != nil {
+		log.Printf("Failed to write email body: %v", err)
+		return false, err
+	}
+
+	logInfoln("Email body written successfully.")
+	return truncated, nil
+}
+
+// renderMarkdown converts a Markdown body to HTML.
+//
+// @param body: Markdown text
+// @return string: HTML
+// @return error: error if any
+func renderMarkdown(body string) (string, error) {
+	var html bytes.Buffer
+	if err := goldmark.Convert([]byte(body), &html); err != nil {
+		log.Printf("Failed to convert Markdown body to HTML: %v", err)
+		return "", err
 	}
+	return html.String(), nil
+}
+
+// bodyAttachment returns the attachment holding the full body of an email whose
+// body was truncated. Markdown bodies are attached as rendered HTML. With
+// GzipBody set, the attachment is gzip-compressed.
+//
+// @param email: email
+// @return Attachment: full body attachment
+// @return error: error if any
+func bodyAttachment(email Email) (Attachment, error) {
+	attachment := Attachment{
+		fileName: bodyFileName + ".txt",
+		mimeType: "text/plain; charset=utf-8",
+		file:     bytes.NewBufferString(email.Body),
+		encoding: encodingQuotedPrintable,
+	}
+	if email.Markdown {
+		html, err := renderMarkdown(email.Body)
+		if err != nil {
+			return Attachment{}, err
+		}
+		attachment.fileName = bodyFileName + ".html"
+		attachment.mimeType = "text/html; charset=utf-8"
+		attachment.file = bytes.NewBufferString(html)
+	}
+
+	if email.GzipBody {
+		compressed := new(bytes.Buffer)
+		gz := gzip.NewWriter(compressed)
+		if _, err := gz.Write(attachment.file.Bytes()); err != nil {
+			log.Printf("Failed to compress email body: %v", err)
+			return Attachment{}, err
+		}
+		if err := gz.Close(); err != nil {
+			log.Printf("Failed to compress email body: %v", err)
+			return Attachment{}, err
+		}
+		attachment.fileName += ".gz"
+		attachment.mimeType = "application/gzip"
+		attachment.file = compressed
+		attachment.encoding = encodingBase64
+	}
+	return attachment, nil
+}
+
+// writeTextPart writes a quoted-printable text part to the multipart writer.
+//
+// @param writer: multipart writer
+// @param contentType: content type of the part
+// @param text: part content
+// @return error: error if any
+func writeTextPart(writer *multipart.Writer, contentType string, text string) error {
+	// Create a new MIME part for the email body
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		log.Printf("Failed to create MIME part for email body: %v", err)
+		return err
+	}
+
+	// Create a new quoted-printable writer
+	qp := quotedprintable.NewWriter(part)
+
+	// Write the email body to the part
+	if _, err = qp.Write([]byte(text)); err != nil {
+		log.Printf("Failed to write email body: %v", err)
+		return err
+	}
+	if err = qp.Close(); err != nil {
+		log.Printf("Failed to write email body: %v", err)
+		return err
+	}
+	return nil
+}
+
+// writeAttachment writes the attachment to the multipart writer.
+//
+// @param writer: multipart writer
+// @param attachment: attachment buffer
+// @param fileName: attachment file name
+// @param mimeType: attachment MIME type
+// @param encoding: content transfer encoding
+// @return error: error if any
+func writeAttachment(writer *multipart.Writer, attachment *bytes.Buffer, fileName, mimeType, encoding string) error {
+	logInfof("Writing email attachment: %s (%s)...", fileName, encoding)
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mimeType},
+		"Content-Transfer-Encoding": {encoding},
+		"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, fileName)},
+	})
+	if err != nil {
+		log.Printf("Failed to create MIME part for attachment: %v", err)
+		return err
+	}
+
+	var encoder io.WriteCloser
+	switch encoding {
+	case encoding8Bit:
+		encoder = nopWriteCloser{part}
+	case encodingQuotedPrintable:
+		qp := quotedprintable.NewWriter(part)
+		// Only text keeps its line breaks, anything else is encoded byte for byte
+		qp.Binary = !strings.HasPrefix(mimeType, "text/")
+		encoder = qp
+	default:
+		encoder = base64.NewEncoder(base64.StdEncoding, part)
+	}
+	defer encoder.Close()
+
+	// Read from a copy so the same attachment can be sent to several recipients
+	_, err = io.Copy(encoder, bytes.NewReader(attachment.Bytes()))
+	if err != nil {
+		log.Printf("Failed to write attachment: %v", err)
+		return err
+	}
+
+	logInfof("Attachment %s written successfully.", fileName)
+	return nil
+}
+
+// nopWriteCloser adds a no-op Close method to an io.Writer.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer.
+//
+// @return error: always nil
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// RecipientError reports recipients rejected by the SMTP server while the
+// message was still delivered to the remaining accepted recipients.
+type RecipientError struct {
+	Rejected map[string]error
+}
+
+// Error implements the error interface.
+//
+// @return string: error message
+func (e *RecipientError) Error() string {
+	addresses := make([]string, 0, len(e.Rejected))
+	for address := range e.Rejected {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	details := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		details = append(details, fmt.Sprintf("%s (%v)", address, e.Rejected[address]))
+	}
+	return fmt.Sprintf("%d recipient(s) rejected: %s", len(addresses), strings.Join(details, ", "))
+}
+
+// Email represents an email to be sent.
+type Email struct {
+	From        string
+	To          []string
+	Subject     string
+	Body        string
+	Attachments []Attachment
+	// Headers holds additional message headers, such as the priority headers
+	Headers map[string]string
+	// MaxBodyLength truncates longer bodies, attaching the full body instead
+	MaxBodyLength int
+	// Markdown sends the body as Markdown together with its HTML rendering
+	Markdown bool
+	// GzipBody compresses the full body attached to truncated emails
+	GzipBody bool
+	// ReturnPath is the envelope sender that receives bounces, defaulting to From
+	ReturnPath string
+}
+
+// Email priorities and the X-Priority / Importance header values they map to.
+var priorityHeaders = map[string][2]string{
+	"high":   {"1 (Highest)", "High"},
+	"normal": {"3 (Normal)", "Normal"},
+	"low":    {"5 (Lowest)", "Low"},
+}
+
+// priorityHeaderValues returns the headers flagging an email with the given
+// priority. Normal priority, the default, adds no headers.
+//
+// @param priority: email priority (high, normal or low)
+// @return map[string]string: priority headers
+func priorityHeaderValues(priority string) map[string]string {
+	values, ok := priorityHeaders[priority]
+	if !ok || priority == "normal" {
+		return nil
+	}
+	return map[string]string{
+		"X-Priority": values[0],
+		"Importance": values[1],
+	}
+}
+
+// messageBoundary replaces the random MIME boundary when set, so tests can
+// compare rendered messages byte for byte.
+var messageBoundary string
+
+// buildMessage renders the full MIME message with headers, body and attachments.
+//
+// @param email: email to render
+// @param eightBit: whether the server advertises 8BITMIME
+// @return []byte: rendered message
+// @return error: error if any
+func buildMessage(email Email, eightBit bool) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if messageBoundary != "" {
+		if err := writer.SetBoundary(messageBoundary); err != nil {
+			log.Printf("Failed to set MIME boundary: %v", err)
+			return nil, err
+		}
+	}
+
+	headers := map[string]string{
+		"From":         email.From,
+		"To":           strings.Join(email.To, ", "),
+		"Subject":      email.Subject,
+		"MIME-Version": "1.0",
+		"Content-Type": fmt.Sprintf("multipart/mixed; boundary=%s", writer.Boundary()),
+	}
+	for key, value := range email.Headers {
+		headers[key] = value
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteString(fmt.Sprintf("%s: %s\r\n", key, headers[key]))
+	}
+	buf.WriteString("\r\n")
+
+	truncated, err := writeBody(writer, email.Body, email.MaxBodyLength, email.Markdown)
+	if err != nil {
+		log.Printf("Failed to write email body: %v", err)
+		return nil, err
+	}
+
+	attachments := email.Attachments
+	if truncated {
+		attachment, err := bodyAttachment(email)
+		if err != nil {
+			log.Printf("Failed to attach email body: %v", err)
+			return nil, err
+		}
+		attachments = append([]Attachment{attachment}, attachments...)
+	}
+
+	for _, attachment := range attachments {
+		encoding := attachment.transferEncoding(eightBit)
+		if err := writeAttachment(writer, attachment.file, attachment.fileName, attachment.mimeType, encoding); err != nil {
+			log.Printf("Failed to write attachment: %v", err)
+			return nil, err
+		}
+	}
+
+	// Close the writer to emit the closing boundary before the message is sent
+	if err := writer.Close(); err != nil {
+		log.Printf("Failed to finalize email message: %v", err)
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// smtpConnections caps the SMTP connections open at the same time across all
+// posts when max_smtp_connections is set; nil means no limit.
+var smtpConnections chan struct{}
+
+// openSMTPClient connects to an SMTP server, starting TLS when configured, and
+// authenticates unless the server is in plain mode. Each step must complete
+// within the server timeout.
+//
+// @param ctx: run context
+// @param server: SMTP server configuration
+// @return net.Conn: connection, used to extend its deadline
+// @return *smtp.Client: client, to be closed by the caller
+// @return error: error if any
+func openSMTPClient(ctx context.Context, server SMTPServerConfig) (net.Conn, *smtp.Client, error) {
+	timeout := server.timeout()
+	serverAddress := net.JoinHostPort(server.Host, strconv.Itoa(server.Port))
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if server.Plain {
+		log.Printf("Warning: connecting to SMTP server %s in plain mode, without TLS or authentication", serverAddress)
+		conn, err = dialer.DialContext(ctx, "tcp", serverAddress)
+	} else if server.TLSMode == tlsModeStartTLS {
+		conn, err = dialer.DialContext(ctx, "tcp", serverAddress)
+	} else {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{InsecureSkipVerify: false}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", serverAddress)
+	}
+	if err != nil {
+		log.Printf("Failed to connect to SMTP server: %v", err)
+		return nil, nil, err
+	}
+
+	// A cancelled run closes the connection, which fails the step in progress
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// Each protocol phase gets its own deadline so a stuck server fails fast
+	extendDeadline := func() {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	extendDeadline()
+	client, err := smtp.NewClient(conn, server.Host)
+	if err != nil {
+		log.Printf("Failed to create SMTP client: %v", err)
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if server.TLSMode == tlsModeStartTLS && !server.Plain {
+		extendDeadline()
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			err := fmt.Errorf("server %s does not support STARTTLS", serverAddress)
+			log.Printf("Failed to start TLS: %v", err)
+			client.Close()
+			return nil, nil, err
+		}
+		if err = client.StartTLS(&tls.Config{ServerName: server.Host}); err != nil {
+			log.Printf("Failed to start TLS: %v", err)
+			client.Close()
+			return nil, nil, err
+		}
+	}
+
+	if !server.Plain {
+		extendDeadline()
+		auth := smtp.PlainAuth("", server.Username, server.Password, server.Host)
+		if err = client.Auth(auth); err != nil {
+			log.Printf("SMTP authentication failed: %v", err)
+			client.Close()
+			return nil, nil, err
+		}
+	}
+
+	return conn, client, nil
+}
+
+// deliverMessage delivers a message through a single SMTP server. The message is
+// rendered once the server's extensions are known, so that 8bit attachments can
+// be used when it advertises 8BITMIME. Recipients rejected by the server are
+// skipped and reported through a *RecipientError, as long as at least one
+// recipient was accepted.
+//
+// @param ctx: run context; cancelling it closes the connection
+// @param server: SMTP server configuration
+// @param from: email sender
+// @param to: email recipients
+// @param render: renders the message, given 8BITMIME support
+// @return error: error if any
+func deliverMessage(ctx context.Context, server SMTPServerConfig, from string, to []string, render func(eightBit bool) ([]byte, error)) error {
+	if smtpConnections != nil {
+		select {
+		case smtpConnections <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-smtpConnections }()
+	}
+
+	conn, client, err := openSMTPClient(ctx, server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// The remaining protocol phases get their own deadlines as well
+	extendDeadline := func() {
+		conn.SetDeadline(time.Now().Add(server.timeout()))
+	}
+
+	eightBit, _ := client.Extension("8BITMIME")
+	message, err := render(eightBit)
+	if err != nil {
+		return err
+	}
+
+	extendDeadline()
+	if err = client.Mail(from); err != nil {
+		log.Printf("Failed to set sender: %v", err)
+		return err
+	}
+
+	rejected := make(map[string]error)
+	for _, recipient := range to {
+		extendDeadline()
+		if err = client.Rcpt(recipient); err != nil {
+			log.Printf("Recipient %s rejected: %v", recipient, err)
+			rejected[recipient] = err
+		}
+	}
+	if len(rejected) == len(to) {
+		log.Printf("All recipients rejected by SMTP server")
+		return &RecipientError{Rejected: rejected}
+	}
+
+	extendDeadline()
+	writerClient, err := client.Data()
+	if err != nil {
+		log.Printf("Failed to start email data transfer: %v", err)
+		return err
+	}
+
+	extendDeadline()
+	if _, err = writerClient.Write(message); err != nil {
+		log.Printf("Failed to send email data: %v", err)
+		return err
+	}
+
+	extendDeadline()
+	if err = writerClient.Close(); err != nil {
+		log.Printf("Failed to finish email data transfer: %v", err)
+		return err
+	}
+
+	if len(rejected) > 0 {
+		return &RecipientError{Rejected: rejected}
+	}
+	return nil
+}
+
+// SendEmail sends an email with attachments, trying each SMTP server in order
+// until one of them accepts the message. When only some recipients are rejected,
+// the message is still delivered to the others and a *RecipientError is returned.
+//
+// @param servers: SMTP servers to try in order
+// @param email: email to send
+// @return error: error if any
+func SendEmail(servers []SMTPServerConfig, email Email) error {
+	_, err := sendEmail(context.Background(), servers, email)
+	return err
+}
+
+// sendEmail works like SendEmail and also returns the size of the message
+// handed to the server. Cancelling the context aborts the delivery.
+//
+// @param ctx: run context
+// @param servers: SMTP servers to try in order
+// @param email: email to send
+// @return int: message size in bytes
+// @return error: error if any
+func sendEmail(ctx context.Context, servers []SMTPServerConfig, email Email) (int, error) {
+	recipients := strings.Join(email.To, ", ")
+	logInfof("Starting to prepare email to: %s", recipients)
+
+	if len(servers) == 0 {
+		err := fmt.Errorf("no SMTP server configured")
+		log.Printf("Failed to send email: %v", err)
+		return 0, err
+	}
+
+	// Render each variant of the message at most once across all servers
+	messages := make(map[bool][]byte, 2)
+	size := 0
+	render := func(eightBit bool) ([]byte, error) {
+		if message, ok := messages[eightBit]; ok {
+			size = len(message)
+			return message, nil
+		}
+		message, err := buildMessage(email, eightBit)
+		if err != nil {
+			return nil, err
+		}
+		logMessageDump(message, email.To)
+		messages[eightBit] = message
+		size = len(message)
+		return message, nil
+	}
+
+	envelopeFrom := email.From
+	if email.ReturnPath != "" {
+		envelopeFrom = email.ReturnPath
+	}
+
+	errs := make([]error, 0, len(servers))
+	for _, server := range servers {
+		if err := ctx.Err(); err != nil {
+			return size, err
+		}
+		logInfof("Sending email to %s via SMTP server %s:%d", recipients, server.Host, server.Port)
+		if err := deliverMessage(ctx, server, envelopeFrom, email.To, render); err != nil {
+			// Rejected recipients are an address problem, another server will not help
+			var recipientErr *RecipientError
+			if errors.As(err, &recipientErr) {
+				log.Printf("SMTP server %s:%d rejected recipients: %v", server.Host, server.Port, err)
+				return size, err
+			}
+
+			log.Printf("SMTP server %s:%d failed: %v", server.Host, server.Port, err)
+			errs = append(errs, fmt.Errorf("%s:%d: %w", server.Host, server.Port, err))
+			continue
+		}
+
+		logInfof("Successfully sent email to %s via SMTP server %s:%d", recipients, server.Host, server.Port)
+		return size, nil
+	}
+
+	return 0, fmt.Errorf("all SMTP servers failed: %w", errors.Join(errs...))
+}
+
+// matchColumnPatterns reports whether the column name matches any of the glob patterns.
+// Matching is case-insensitive, since DM folds unquoted identifiers to upper case.
+//
+// @param column: column name
+// @param patterns: glob patterns
+// @return bool: true if any pattern matches
+// @return error: error if any pattern is malformed
+func matchColumnPatterns(column string, patterns []string) (bool, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToUpper(pattern), strings.ToUpper(column))
+		if err != nil {
+			return false, fmt.Errorf("invalid column pattern %q: %w", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ResultSet represents the rows of a table read into memory, so that the same
+// data can be written into several attachment formats.
+type ResultSet struct {
+	Columns []string
+	Types   []*sql.ColumnType
+	// Rows holds the raw column values; a nil value represents NULL
+	Rows [][][]byte
+}
+
+// queryer runs queries. It is implemented by *sql.DB and by *sql.Tx, so that
+// the queries of a post can share a transaction.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// tableQuery returns the query used to read a table, sorted by order_by and
+// limited to the first limit rows when configured.
+//
+// @param attachmentConfig: table attachment configuration
+// @return string: SQL query
+func tableQuery(attachmentConfig TableAttachmentConfig) string {
+	query := tableSelect(attachmentConfig)
+	if len(attachmentConfig.OrderBy) > 0 {
+		query += " ORDER BY " + strings.Join(attachmentConfig.OrderBy, ", ")
+	}
+	if attachmentConfig.Limit > 0 {
+		query += fmt.Sprintf(" FETCH FIRST %d ROWS ONLY", attachmentConfig.Limit)
+	}
+	return query
+}
+
+// tableSelect returns the unsorted query reading a table: all of its columns,
+// or with group_by and aggregate set, the group columns followed by the
+// aggregates, grouped by the group columns. Column names are validated, so they
+// are safe to put into the query.
+//
+// @param attachmentConfig: table attachment configuration
+// @return string: SQL query
+func tableSelect(attachmentConfig TableAttachmentConfig) string {
+	if len(attachmentConfig.GroupBy) == 0 && len(attachmentConfig.Aggregate) == 0 {
+		return fmt.Sprintf("SELECT * FROM %s", attachmentConfig.Table)
+	}
+
+	columns := append([]string{}, attachmentConfig.GroupBy...)
+	for _, aggregate := range attachmentConfig.Aggregate {
+		columns = append(columns, fmt.Sprintf("%s(%s) AS %s", strings.ToUpper(aggregate.Function), aggregate.Column, aggregate.alias()))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), attachmentConfig.Table)
+	if len(attachmentConfig.GroupBy) > 0 {
+		query += " GROUP BY " + strings.Join(attachmentConfig.GroupBy, ", ")
+	}
+	return query
+}
+
+// tableSchemaQuery returns a query yielding the columns of a table without
+// reading any of its rows.
+//
+// @param attachmentConfig: table attachment configuration
+// @return string: SQL query
+func tableSchemaQuery(attachmentConfig TableAttachmentConfig) string {
+	return fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", attachmentConfig.Table)
+}
+
+// tablePageQuery returns the query reading one page of a table.
+//
+// @param attachmentConfig: table attachment configuration
+// @param offset: number of rows to skip
+// @param size: number of rows to read
+// @return string: SQL query
+func tablePageQuery(attachmentConfig TableAttachmentConfig, offset int, size int) string {
+	query := tableSelect(attachmentConfig)
+	if len(attachmentConfig.OrderBy) > 0 {
+		query += " ORDER BY " + strings.Join(attachmentConfig.OrderBy, ", ")
+	}
+	return query + fmt.Sprintf(" OFFSET %d ROWS FETCH NEXT %d ROWS ONLY", offset, size)
+}
+
+// queryTable reads a table from the database, dropping excluded columns. Tables
+// with page_size set are read by exportPagedTable instead.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return *ResultSet: table rows
+// @return error: error if any
+func queryTable(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) (*ResultSet, error) {
+	return runQuery(ctx, db, tableQuery(attachmentConfig), "table "+attachmentConfig.Table, attachmentConfig)
+}
+
+// runQuery runs a query, dropping excluded columns and applying the value map
+// of the attachment.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param query: SQL query
+// @param source: description of the queried data used in log messages
+// @param attachmentConfig: table attachment configuration
+// @return *ResultSet: query rows
+// @return error: error if any
+func runQuery(ctx context.Context, db queryer, query string, source string, attachmentConfig TableAttachmentConfig) (*ResultSet, error) {
+	logInfof("Starting to query %s", source)
+
+	ctx, cancel := attachmentConfig.queryContext(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		log.Printf("Failed to query %s: %v", source, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		log.Printf("Failed to get columns from %s: %v", source, err)
+		return nil, err
+	}
+	// A statement such as DDL runs without error but yields no result to export
+	if len(columns) == 0 {
+		err := fmt.Errorf("%s of attachment %s returned no columns, expected a SELECT statement", source, attachmentConfig.Excel)
+		log.Printf("Failed to export query result: %v", err)
+		return nil, err
+	}
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		log.Printf("Failed to get column types from %s: %v", source, err)
+		return nil, err
+	}
+
+	// Indexes of the columns kept in the result, after dropping excluded ones
+	included := make([]int, 0, len(columns))
+	binaryColumns := make(map[int]bool)
+	result := &ResultSet{}
+	for i, colName := range columns {
+		excluded, err := matchColumnPatterns(colName, attachmentConfig.ExcludeColumns)
+		if err != nil {
+			log.Printf("Failed to filter columns of %s: %v", source, err)
+			return nil, err
+		}
+		if excluded {
+			logInfof("Excluding column %s from %s", colName, source)
+			continue
+		}
+		if isBinaryColumn(columnTypes[i]) {
+			if attachmentConfig.BinaryColumns == binaryOmit {
+				logInfof("Omitting binary column %s from %s", colName, source)
+				continue
+			}
+			binaryColumns[len(included)] = true
+		}
+		included = append(included, i)
+		result.Columns = append(result.Columns, colName)
+		result.Types = append(result.Types, columnTypes[i])
+	}
+
+	// LOB columns are scanned as driver values so they can be streamed
+	values := make([]sql.RawBytes, len(columns))
+	lobValues := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(values))
+	for i := range values {
+		if isLOBColumn(columnTypes[i]) {
+			scanArgs[i] = &lobValues[i]
+		} else {
+			scanArgs[i] = &values[i]
+		}
+	}
+
+	for rows.Next() {
+		err = rows.Scan(scanArgs...)
+		if err != nil {
+			log.Printf("Failed to scan row in %s: %v", source, err)
+			return nil, err
+		}
+
+		// RawBytes are only valid until the next Scan, so keep a copy
+		row := make([][]byte, len(included))
+		for colNum, colIndex := range included {
+			if isLOBColumn(columnTypes[colIndex]) {
+				if row[colNum], err = readLOB(lobValues[colIndex], attachmentConfig.maxLOBLength(), attachmentConfig.BinaryColumns); err != nil {
+					log.Printf("Failed to read column %s in %s: %v", columns[colIndex], source, err)
+					return nil, err
+				}
+			} else if value := values[colIndex]; value != nil && binaryColumns[colNum] {
+				row[colNum] = formatBinary(value, attachmentConfig.BinaryColumns)
+			} else if value != nil {
+				row[colNum] = make([]byte, len(value))
+				copy(row[colNum], value)
+			}
+		}
+		result.Rows = append(result.Rows, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error during row iteration for %s: %v", source, err)
+		return nil, err
+	}
+
+	applyValueMap(result, attachmentConfig.ValueMap)
+	applyMasks(result, attachmentConfig.Mask)
+
+	logInfof("Read %d rows from %s", len(result.Rows), source)
+	return result, nil
+}
+
+// isBinaryColumn reports whether a column holds binary data.
+//
+// @param columnType: column type
+// @return bool: true for binary columns
+func isBinaryColumn(columnType *sql.ColumnType) bool {
+	switch strings.ToUpper(columnType.DatabaseTypeName()) {
+	case "BLOB", "IMAGE", "BINARY", "VARBINARY", "LONGVARBINARY", "BFILE":
+		return true
+	}
+	return false
+}
+
+// formatBinary converts a binary value into cell text: base64 when configured,
+// otherwise a placeholder giving its size.
+//
+// @param value: binary value
+// @param mode: binary_columns setting
+// @return []byte: cell text
+func formatBinary(value []byte, mode string) []byte {
+	if mode == binaryBase64 {
+		return []byte(base64.StdEncoding.EncodeToString(value))
+	}
+	return []byte(fmt.Sprintf("[binary %d bytes]", len(value)))
+}
+
+// applyValueMap replaces coded column values with their configured labels.
+// Column names are matched case-insensitively; NULL and unmapped values are kept.
+//
+// @param result: table rows
+// @param valueMap: column name to value labels
+func applyValueMap(result *ResultSet, valueMap map[string]map[string]string) {
+	if len(valueMap) == 0 {
+		return
+	}
+
+	labels := make([]map[string]string, len(result.Columns))
+	for column, mapping := range valueMap {
+		for i, colName := range result.Columns {
+			if strings.EqualFold(column, colName) {
+				labels[i] = mapping
+			}
+		}
+	}
+
+	for _, row := range result.Rows {
+		for i, value := range row {
+			if value == nil || labels[i] == nil {
+				continue
+			}
+			if label, ok := labels[i][string(value)]; ok {
+				row[i] = []byte(label)
+			}
+		}
+	}
+}
+
+// Supported column masks.
+const (
+	maskFull  = "full"
+	maskLast4 = "last4"
+	maskHash  = "hash"
+)
+
+// applyMasks hides the values of sensitive columns before they are written to
+// any attachment. Column names are matched case-insensitively; NULL values are kept.
+//
+// @param result: table rows
+// @param masks: column name to mask
+func applyMasks(result *ResultSet, masks map[string]string) {
+	if len(masks) == 0 {
+		return
+	}
+
+	modes := make([]string, len(result.Columns))
+	for column, mode := range masks {
+		for i, colName := range result.Columns {
+			if strings.EqualFold(column, colName) {
+				modes[i] = mode
+			}
+		}
+	}
+
+	for _, row := range result.Rows {
+		for i, value := range row {
+			if value != nil && modes[i] != "" {
+				row[i] = maskValue(value, modes[i])
+			}
+		}
+	}
+}
+
+// maskValue masks a single value: every character replaced by "*", all but the
+// last four characters replaced, or the SHA-256 hash of the value in hex.
+//
+// @param value: column value
+// @param mode: mask
+// @return []byte: masked value
+func maskValue(value []byte, mode string) []byte {
+	switch mode {
+	case maskHash:
+		sum := sha256.Sum256(value)
+		return []byte(hex.EncodeToString(sum[:]))
+	case maskLast4:
+		runes := []rune(string(value))
+		if len(runes) <= 4 {
+			return []byte(strings.Repeat("*", len(runes)))
+		}
+		return []byte(strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:]))
+	default:
+		return []byte(strings.Repeat("*", utf8.RuneCount(value)))
+	}
+}
+
+// writeExcel writes a result set to an Excel file. With split_by set, the rows
+// are grouped by that column and each group is written to its own sheet.
+//
+// @param result: table rows
+// @param attachmentConfig: table attachment configuration
+// @return *bytes.Buffer: Excel file buffer
+// @return error: error if any
+func writeExcel(result *ResultSet, attachmentConfig TableAttachmentConfig) (*bytes.Buffer, error) {
+	file := excelize.NewFile()
+	defer file.Close()
+
+	if attachmentConfig.SplitBy == "" {
+		if err := writeSheet(file, "Sheet1", result, attachmentConfig); err != nil {
+			return nil, err
+		}
+	} else {
+		groups, err := splitResultSet(result, attachmentConfig)
+		if err != nil {
+			log.Printf("Failed to split rows by %s: %v", attachmentConfig.SplitBy, err)
+			return nil, err
+		}
+
+		for i, group := range groups {
+			if i == 0 {
+				if err := file.SetSheetName("Sheet1", group.sheetName); err != nil {
+					log.Printf("Failed to rename Excel sheet: %v", err)
+					return nil, err
+				}
+			} else if _, err := file.NewSheet(group.sheetName); err != nil {
+				log.Printf("Failed to create Excel sheet: %v", err)
+				return nil, err
+			}
+
+			if err := writeSheet(file, group.sheetName, group.result, attachmentConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(attachmentConfig.Descriptions) > 0 {
+		if err := writeColumnsSheet(file, result, attachmentConfig.Descriptions); err != nil {
+			log.Printf("Failed to write column descriptions: %v", err)
+			return nil, err
+		}
+	}
+
+	file.SetActiveSheet(0)
+
+	buffer := new(bytes.Buffer)
+	if err := file.Write(buffer); err != nil {
+		log.Printf("Failed to write Excel file to buffer: %v", err)
+		return nil, err
+	}
+
+	return buffer, nil
+}
+
+// writeColumnsSheet adds a "Columns" sheet listing each exported column with its
+// database type and configured description. Descriptions are matched to columns
+// case-insensitively.
+//
+// @param file: Excel file
+// @param result: table rows
+// @param descriptions: column name to description
+// @return error: error if any
+func writeColumnsSheet(file *excelize.File, result *ResultSet, descriptions map[string]string) error {
+	usedNames := make(map[string]bool)
+	for _, name := range file.GetSheetList() {
+		usedNames[strings.ToLower(name)] = true
+	}
+	sheetName := uniqueSheetName("Columns", usedNames)
+	if _, err := file.NewSheet(sheetName); err != nil {
+		return err
+	}
+
+	file.SetSheetRow(sheetName, "A1", &[]string{"Column", "Type", "Description"})
+	for i, colName := range result.Columns {
+		typeName := ""
+		if i < len(result.Types) && result.Types[i] != nil {
+			typeName = result.Types[i].DatabaseTypeName()
+		}
+
+		description := ""
+		for column, text := range descriptions {
+			if strings.EqualFold(column, colName) {
+				description = text
+				break
+			}
+		}
+
+		cell, _ := excelize.CoordinatesToCellName(1, i+2)
+		file.SetSheetRow(sheetName, cell, &[]string{colName, typeName, description})
+	}
+	return nil
+}
+
+// exportTableSchema exports the structure of a table as a workbook with a single
+// "Columns" sheet listing its column names, types and descriptions. No rows are
+// read from the table.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return Attachment: Excel attachment
+// @return error: error if any
+func exportTableSchema(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) (Attachment, error) {
+	logInfof("Starting to export schema of table %s", attachmentConfig.Table)
+
+	result, err := runQuery(ctx, db, tableSchemaQuery(attachmentConfig), "schema of table "+attachmentConfig.Table, attachmentConfig)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	fileName, err := resolveFileName(attachmentConfig.Excel, result)
+	if err != nil {
+		log.Printf("Failed to resolve file name of table %s: %v", attachmentConfig.Table, err)
+		return Attachment{}, err
+	}
+
+	file := excelize.NewFile()
+	defer file.Close()
+	defaultSheet := file.GetSheetName(0)
+	if err := writeColumnsSheet(file, result, attachmentConfig.Descriptions); err != nil {
+		log.Printf("Failed to write columns sheet: %v", err)
+		return Attachment{}, err
+	}
+	if err := file.DeleteSheet(defaultSheet); err != nil {
+		log.Printf("Failed to delete default sheet: %v", err)
+		return Attachment{}, err
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := file.Write(buffer); err != nil {
+		log.Printf("Failed to write Excel file to buffer: %v", err)
+		return Attachment{}, err
+	}
+
+	logInfof("Successfully exported schema of table %s (%d columns)", attachmentConfig.Table, len(result.Columns))
+	return Attachment{
+		fileName: fileName,
+		mimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		file:     buffer,
+	}, nil
+}
+
+// writeSheet writes a result set into a sheet, along with the optional title,
+// conditional formats and totals row.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param result: table rows
+// @param attachmentConfig: table attachment configuration
+// @return error: error if any
+func writeSheet(file *excelize.File, sheetName string, result *ResultSet, attachmentConfig TableAttachmentConfig) error {
+	if attachmentConfig.AddRowNumbers {
+		result = withRowNumbers(result)
+	}
+
+	if attachmentConfig.Title != "" {
+		file.SetCellValue(sheetName, "A1", attachmentConfig.Title)
+		titleStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true, Size: 14}})
+		if err != nil {
+			log.Printf("Failed to create title style: %v", err)
+			return err
+		}
+		file.SetCellStyle(sheetName, "A1", "A1", titleStyle)
+	}
+
+	headerRow := attachmentConfig.headerRow()
+	for i, colName := range result.Columns {
+		cell, _ := excelize.CoordinatesToCellName(i+1, headerRow)
+		file.SetCellValue(sheetName, cell, colName)
+	}
+
+	totalColumns := make(map[int]bool, len(attachmentConfig.Totals))
+	for _, column := range attachmentConfig.Totals {
+		colIndex := columnIndex(result.Columns, column)
+		if colIndex < 0 {
+			err := fmt.Errorf("totals column %s not found", column)
+			log.Printf("Failed to add totals row: %v", err)
+			return err
+		}
+		totalColumns[colIndex] = true
+	}
+
+	// Summed and conditionally formatted columns are written as numbers, so that
+	// formulas and value comparisons work on them
+	numericColumns := make(map[int]bool, len(totalColumns))
+	for colIndex := range totalColumns {
+		numericColumns[colIndex] = true
+	}
+	if attachmentConfig.AddRowNumbers {
+		numericColumns[0] = true
+	}
+	for _, rule := range attachmentConfig.Conditional {
+		colIndex := columnIndex(result.Columns, rule.Column)
+		if colIndex < 0 {
+			err := fmt.Errorf("conditional format column %s not found", rule.Column)
+			log.Printf("Failed to add conditional format: %v", err)
+			return err
+		}
+		numericColumns[colIndex] = true
+	}
+	if chart := attachmentConfig.Chart; chart != nil {
+		for _, column := range append([]string{chart.Category}, chart.Values...) {
+			if columnIndex(result.Columns, column) < 0 {
+				err := fmt.Errorf("chart column %s not found", column)
+				log.Printf("Failed to add chart: %v", err)
+				return err
+			}
+		}
+		for _, column := range chart.Values {
+			numericColumns[columnIndex(result.Columns, column)] = true
+		}
+	}
+
+	dateColumns, err := columnKinds(result, attachmentConfig, numericColumns)
+	if err != nil {
+		return err
+	}
+
+	rowNum := headerRow + 1
+	for _, row := range result.Rows {
+		for colNum, value := range row {
+			cell, _ := excelize.CoordinatesToCellName(colNum+1, rowNum)
+			file.SetCellValue(sheetName, cell, cellValue(value, numericColumns[colNum], dateColumns[colNum]))
+		}
+		rowNum++
+	}
+
+	if err := applySheetStyles(file, sheetName, result, headerRow, rowNum-1, dateColumns, attachmentConfig); err != nil {
+		log.Printf("Failed to apply cell styles: %v", err)
+		return err
+	}
+
+	if rowNum > headerRow+1 {
+		for _, rule := range attachmentConfig.Conditional {
+			if err := setConditionalFormat(file, sheetName, columnIndex(result.Columns, rule.Column), headerRow+1, rowNum-1, rule); err != nil {
+				log.Printf("Failed to add conditional format on column %s: %v", rule.Column, err)
+				return err
+			}
+		}
+	}
+
+	if attachmentConfig.Chart != nil && rowNum > headerRow+1 {
+		if err := addChart(file, sheetName, result.Columns, headerRow, rowNum-1, attachmentConfig.Chart); err != nil {
+			log.Printf("Failed to add chart: %v", err)
+			return err
+		}
+	}
+
+	if len(totalColumns) > 0 {
+		if err := writeTotalsRow(file, sheetName, len(result.Columns), totalColumns, headerRow+1, rowNum); err != nil {
+			log.Printf("Failed to add totals row: %v", err)
+			return err
+		}
+	}
+
+	if attachmentConfig.Print != nil {
+		if err := setPrintLayout(file, sheetName, headerRow, attachmentConfig); err != nil {
+			log.Printf("Failed to set print layout: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setPrintLayout prepares a sheet for printing: the rows up to the header row
+// are repeated at the top of every page, and each page gets a header and footer.
+// By default the header shows the title (or the sheet name) and the footer the
+// print date and page number.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param headerRow: row number of the column headers
+// @param attachmentConfig: table attachment configuration
+// @return error: error if any
+func setPrintLayout(file *excelize.File, sheetName string, headerRow int, attachmentConfig TableAttachmentConfig) error {
+	layout := attachmentConfig.Print
+
+	if err := file.SetDefinedName(&excelize.DefinedName{
+		Name:     "_xlnm.Print_Titles",
+		RefersTo: fmt.Sprintf("'%s'!$1:$%d", strings.ReplaceAll(sheetName, "'", "''"), headerRow),
+		Scope:    sheetName,
+	}); err != nil {
+		return err
+	}
+
+	header := layout.Header
+	if header == "" {
+		title := attachmentConfig.Title
+		if title == "" {
+			title = sheetName
+		}
+		// & starts a formatting code in headers and footers
+		header = `&C&"-,Bold"` + strings.ReplaceAll(title, "&", "&&")
+	}
+	footer := layout.Footer
+	if footer == "" {
+		footer = "&L&D&RPage &P of &N"
+	}
+	if err := file.SetHeaderFooter(sheetName, &excelize.HeaderFooterOptions{OddHeader: header, OddFooter: footer}); err != nil {
+		return err
+	}
+
+	if layout.Orientation != "" {
+		orientation := layout.Orientation
+		if err := file.SetPageLayout(sheetName, &excelize.PageLayoutOptions{Orientation: &orientation}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sheetGroup represents the rows written to one sheet of a split export.
+type sheetGroup struct {
+	sheetName string
+	result    *ResultSet
+}
+
+// splitResultSet groups rows by the split_by column, in order of first appearance.
+// Each group is named after its value, made safe for use as an Excel sheet name.
+//
+// @param result: table rows
+// @param attachmentConfig: table attachment configuration
+// @return []sheetGroup: row groups
+// @return error: error if any
+func splitResultSet(result *ResultSet, attachmentConfig TableAttachmentConfig) ([]sheetGroup, error) {
+	colIndex := columnIndex(result.Columns, attachmentConfig.SplitBy)
+	if colIndex < 0 {
+		return nil, fmt.Errorf("split_by column %s not found", attachmentConfig.SplitBy)
+	}
+
+	maxSheets := attachmentConfig.MaxSheets
+	if maxSheets <= 0 {
+		maxSheets = defaultMaxSheets
+	}
+
+	groups := make([]sheetGroup, 0)
+	groupIndex := make(map[string]int)
+	usedNames := make(map[string]bool)
+	for _, row := range result.Rows {
+		key := "NULL"
+		if row[colIndex] != nil {
+			key = string(row[colIndex])
+		}
+
+		i, ok := groupIndex[key]
+		if !ok {
+			if len(groups) == maxSheets {
+				return nil, fmt.Errorf("more than %d distinct values in column %s", maxSheets, attachmentConfig.SplitBy)
+			}
+			i = len(groups)
+			groupIndex[key] = i
+			groups = append(groups, sheetGroup{
+				sheetName: uniqueSheetName(key, usedNames),
+				result:    &ResultSet{Columns: result.Columns, Types: result.Types},
+			})
+		}
+		groups[i].result.Rows = append(groups[i].result.Rows, row)
+	}
+
+	// Keep an empty sheet with the header when there are no rows at all
+	if len(groups) == 0 {
+		groups = append(groups, sheetGroup{sheetName: "Sheet1", result: result})
+	}
+
+	return groups, nil
+}
+
+// uniqueSheetName turns a value into a valid Excel sheet name, replacing
+// forbidden characters, truncating to 31 characters and avoiding duplicates.
+//
+// @param value: value to name the sheet after
+// @param usedNames: names already taken, updated with the returned name
+// @return string: sheet name
+func uniqueSheetName(value string, usedNames map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, value)
+	name = strings.Trim(name, "'")
+	if name == "" {
+		name = "EMPTY"
+	}
+
+	base := []rune(name)
+	if len(base) > 31 {
+		base = base[:31]
+	}
+	name = string(base)
+
+	for i := 2; usedNames[strings.ToLower(name)]; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		trimmed := base
+		if len(trimmed)+len(suffix) > 31 {
+			trimmed = trimmed[:31-len(suffix)]
+		}
+		name = string(trimmed) + suffix
+	}
+
+	usedNames[strings.ToLower(name)] = true
+	return name
+}
+
+// SheetStylesConfig represents the cell styles of an exported sheet. Each style
+// is an excelize style definition, e.g. {"Font": {"Bold": true}}.
+type SheetStylesConfig struct {
+	Header *excelize.Style `json:"header"`
+	Data   *excelize.Style `json:"data"`
+	Banded *excelize.Style `json:"banded"`
+}
+
+// rowStyle returns the style of a data row: the banded style on every second
+// row when configured, otherwise the data style.
+//
+// @param row: row offset from the header row, starting at 1
+// @return *excelize.Style: row style, nil if none
+func (s *SheetStylesConfig) rowStyle(row int) *excelize.Style {
+	if s == nil {
+		return nil
+	}
+	if s.Banded != nil && row%2 == 0 {
+		return s.Banded
+	}
+	return s.Data
+}
+
+// applySheetStyles applies the configured header, data and banded row styles,
+// and the date formats of date columns, to a written sheet.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param result: table rows
+// @param headerRow: header row
+// @param lastRow: last data row
+// @param dateColumns: indexes of the date columns
+// @param attachmentConfig: table attachment configuration
+// @return error: error if any
+func applySheetStyles(file *excelize.File, sheetName string, result *ResultSet, headerRow int, lastRow int, dateColumns map[int]bool, attachmentConfig TableAttachmentConfig) error {
+	styles := attachmentConfig.Styles
+	lastCol := len(result.Columns)
+	if lastCol == 0 {
+		return nil
+	}
+
+	if styles != nil && styles.Header != nil {
+		style, err := file.NewStyle(styles.Header)
+		if err != nil {
+			return err
+		}
+		firstCell, _ := excelize.CoordinatesToCellName(1, headerRow)
+		lastCell, _ := excelize.CoordinatesToCellName(lastCol, headerRow)
+		if err := file.SetCellStyle(sheetName, firstCell, lastCell, style); err != nil {
+			return err
+		}
+	}
+
+	if styles == nil || (styles.Data == nil && styles.Banded == nil) {
+		for colIndex := range dateColumns {
+			if lastRow > headerRow {
+				if err := setDateStyle(file, sheetName, colIndex, headerRow+1, lastRow, result.Types[colIndex], attachmentConfig.DateFormat, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	for row := headerRow + 1; row <= lastRow; row++ {
+		base := styles.rowStyle(row - headerRow)
+		if base != nil {
+			style, err := file.NewStyle(base)
+			if err != nil {
+				return err
+			}
+			firstCell, _ := excelize.CoordinatesToCellName(1, row)
+			lastCell, _ := excelize.CoordinatesToCellName(lastCol, row)
+			if err := file.SetCellStyle(sheetName, firstCell, lastCell, style); err != nil {
+				return err
+			}
+		}
+		for colIndex := range dateColumns {
+			if err := setDateStyle(file, sheetName, colIndex, row, row, result.Types[colIndex], attachmentConfig.DateFormat, base); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// columnKinds returns the date columns of a result set, which are written as
+// Excel dates so they display with a date format. Column type hints override
+// the detected types and the given numeric columns, such as keeping numeric
+// looking IDs as text.
+//
+// @param result: table rows
+// @param attachmentConfig: table attachment configuration
+// @param numericColumns: indexes of the columns written as numbers, updated by the hints
+// @return map[int]bool: indexes of the date columns
+// @return error: error if a hinted column does not exist
+func columnKinds(result *ResultSet, attachmentConfig TableAttachmentConfig, numericColumns map[int]bool) (map[int]bool, error) {
+	dateColumns := make(map[int]bool)
+	for i, columnType := range result.Types {
+		if isDateColumn(columnType) {
+			dateColumns[i] = true
+		}
+	}
+
+	for column, columnType := range attachmentConfig.ColumnTypes {
+		colIndex := columnIndex(result.Columns, column)
+		if colIndex < 0 {
+			err := fmt.Errorf("column_types column %s not found", column)
+			log.Printf("Failed to apply column types: %v", err)
+			return nil, err
+		}
+		delete(numericColumns, colIndex)
+		delete(dateColumns, colIndex)
+		switch columnType {
+		case columnTypeNumber:
+			numericColumns[colIndex] = true
+		case columnTypeDate:
+			dateColumns[colIndex] = true
+		}
+	}
+	return dateColumns, nil
+}
+
+// cellValue returns the value written to an Excel cell: "NULL" for NULL
+// values, a number or date for numeric and date columns when the value parses
+// as one, and the text otherwise.
+//
+// @param value: raw column value
+// @param numeric: whether the column is written as numbers
+// @param date: whether the column is written as dates
+// @return interface{}: cell value
+func cellValue(value []byte, numeric bool, date bool) interface{} {
+	if value == nil {
+		return "NULL"
+	}
+	if numeric {
+		if number, err := strconv.ParseFloat(string(value), 64); err == nil {
+			return number
+		}
+	}
+	if date {
+		if parsed, err := parseDateValue(value); err == nil {
+			return parsed
+		}
+	}
+	return string(value)
+}
+
+// rowNumberColumn is the header of the row number column added by add_row_numbers.
+const rowNumberColumn = "#"
+
+// withRowNumbers returns a copy of the rows preceded by a column numbering them
+// from 1. The data columns are left untouched.
+//
+// @param result: table rows
+// @return *ResultSet: rows with a row number column
+func withRowNumbers(result *ResultSet) *ResultSet {
+	numbered := &ResultSet{
+		Columns: append([]string{rowNumberColumn}, result.Columns...),
+		Types:   append([]*sql.ColumnType{nil}, result.Types...),
+		Rows:    make([][][]byte, len(result.Rows)),
+	}
+	for i, row := range result.Rows {
+		numbered.Rows[i] = append([][]byte{[]byte(strconv.Itoa(i + 1))}, row...)
+	}
+	return numbered
+}
+
+// Supported column type hints.
+const (
+	columnTypeText   = "text"
+	columnTypeNumber = "number"
+	columnTypeDate   = "date"
+)
+
+// dateValueLayouts lists the layouts accepted for values of date columns, the
+// first being how the driver's date and time values are formatted.
+var dateValueLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02", "2006/01/02"}
+
+// parseDateValue parses a value of a date column.
+//
+// @param value: column value
+// @return time.Time: parsed date
+// @return error: error if the value matches none of the layouts
+func parseDateValue(value []byte) (time.Time, error) {
+	var err error
+	for _, layout := range dateValueLayouts {
+		var date time.Time
+		if date, err = time.Parse(layout, string(value)); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// isDateColumn reports whether a column holds dates or timestamps. The DM driver
+// scans these as time.Time; time-of-day columns are left as text.
+//
+// @param columnType: column type
+// @return bool: true for date and timestamp columns
+func isDateColumn(columnType *sql.ColumnType) bool {
+	if columnType == nil {
+		return false
+	}
+
+	typeName := strings.ToUpper(columnType.DatabaseTypeName())
+	if strings.HasPrefix(typeName, "TIME") && !strings.HasPrefix(typeName, "TIMESTAMP") {
+		return false
+	}
+
+	scanType := columnType.ScanType()
+	if scanType == reflect.TypeOf(time.Time{}) || scanType == reflect.TypeOf(sql.NullTime{}) {
+		return true
+	}
+	return strings.Contains(typeName, "DATE") || strings.HasPrefix(typeName, "TIMESTAMP")
+}
+
+// setDateStyle applies a date number format to the data range of a column,
+// on top of the given base style if any.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param colIndex: column index
+// @param firstRow: first data row
+// @param lastRow: last data row
+// @param columnType: column type
+// @param dateFormat: configured Excel date format
+// @param base: style the date format is added to, may be nil
+// @return error: error if any
+func setDateStyle(file *excelize.File, sheetName string, colIndex int, firstRow int, lastRow int, columnType *sql.ColumnType, dateFormat string, base *excelize.Style) error {
+	dateFormat = dateNumFmt(columnType, dateFormat)
+	dateStyle := excelize.Style{}
+	if base != nil {
+		dateStyle = *base
+	}
+	dateStyle.CustomNumFmt = &dateFormat
+	style, err := file.NewStyle(&dateStyle)
+	if err != nil {
+		return err
+	}
+
+	firstCell, _ := excelize.CoordinatesToCellName(colIndex+1, firstRow)
+	lastCell, _ := excelize.CoordinatesToCellName(colIndex+1, lastRow)
+	return file.SetCellStyle(sheetName, firstCell, lastCell, style)
+}
+
+// dateNumFmt returns the Excel number format of a date column: the configured
+// format, or else the date only for DATE columns and columns hinted as dates,
+// and the date and time for other date columns.
+//
+// @param columnType: column type
+// @param dateFormat: configured Excel date format
+// @return string: Excel number format
+func dateNumFmt(columnType *sql.ColumnType, dateFormat string) string {
+	if dateFormat != "" {
+		return dateFormat
+	}
+	if !isDateColumn(columnType) || strings.EqualFold(columnType.DatabaseTypeName(), "DATE") {
+		return "yyyy-mm-dd"
+	}
+	return "yyyy-mm-dd hh:mm:ss"
+}
+
+// columnIndex returns the index of a column, matched case-insensitively.
+//
+// @param columns: column names
+// @param name: column name to look up
+// @return int: column index, -1 if not found
+func columnIndex(columns []string, name string) int {
+	for i, column := range columns {
+		if strings.EqualFold(column, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeTotalsRow writes a bold totals row below the data, summing the given columns
+// with SUM formulas. Without data rows the totals are written as zero.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param columnCount: number of columns
+// @param totalColumns: indexes of the summed columns
+// @param firstRow: first data row
+// @param totalsRow: row the totals are written to
+// @return error: error if any
+func writeTotalsRow(file *excelize.File, sheetName string, columnCount int, totalColumns map[int]bool, firstRow int, totalsRow int) error {
+	if !totalColumns[0] {
+		file.SetCellValue(sheetName, fmt.Sprintf("A%d", totalsRow), "Total")
+	}
+
+	for colIndex := range totalColumns {
+		cell, _ := excelize.CoordinatesToCellName(colIndex+1, totalsRow)
+		if totalsRow == firstRow {
+			file.SetCellValue(sheetName, cell, 0)
+			continue
+		}
+
+		column, _ := excelize.ColumnNumberToName(colIndex + 1)
+		formula := fmt.Sprintf("SUM(%s%d:%s%d)", column, firstRow, column, totalsRow-1)
+		if err := file.SetCellFormula(sheetName, cell, formula); err != nil {
+			return err
+		}
+	}
+
+	boldStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		return err
+	}
+	lastCell, _ := excelize.CoordinatesToCellName(columnCount, totalsRow)
+	return file.SetCellStyle(sheetName, fmt.Sprintf("A%d", totalsRow), lastCell, boldStyle)
+}
+
+// setConditionalFormat applies a conditional formatting rule to the data range of a column.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param colIndex: column index
+// @param firstRow: first data row
+// @param lastRow: last data row
+// @param rule: conditional formatting rule
+// @return error: error if any
+func setConditionalFormat(file *excelize.File, sheetName string, colIndex int, firstRow int, lastRow int, rule ConditionalFormatConfig) error {
+	column, _ := excelize.ColumnNumberToName(colIndex + 1)
+	rangeRef := fmt.Sprintf("%s%d:%s%d", column, firstRow, column, lastRow)
+
+	// newFormat registers the font/fill style used by cell comparison rules
+	newFormat := func(fontColor, fillColor string) (*int, error) {
+		style := &excelize.Style{}
+		if fontColor != "" {
+			style.Font = &excelize.Font{Color: fontColor}
+		}
+		if fillColor != "" {
+			style.Fill = excelize.Fill{Type: "pattern", Pattern: 1, Color: []string{fillColor}}
+		}
+		format, err := file.NewConditionalStyle(style)
+		if err != nil {
+			return nil, err
+		}
+		return &format, nil
+	}
+
+	var opts excelize.ConditionalFormatOptions
+	switch rule.Rule {
+	case ruleNegativeRed, rulePositiveGreen:
+		criteria, color := "<", "9C0006"
+		if rule.Rule == rulePositiveGreen {
+			criteria, color = ">", "006100"
+		}
+		format, err := newFormat(color, "")
+		if err != nil {
+			return err
+		}
+		opts = excelize.ConditionalFormatOptions{Type: "cell", Criteria: criteria, Value: "0", Format: format}
+	case ruleColorScale:
+		opts = excelize.ConditionalFormatOptions{
+			Type:     "3_color_scale",
+			Criteria: "=",
+			MinType:  "min",
+			MidType:  "percentile",
+			MaxType:  "max",
+			MidValue: "50",
+			MinColor: "#F8696B",
+			MidColor: "#FFEB84",
+			MaxColor: "#63BE7B",
+		}
+	case ruleDataBar:
+		opts = excelize.ConditionalFormatOptions{
+			Type:     "data_bar",
+			Criteria: "=",
+			MinType:  "min",
+			MaxType:  "max",
+			BarColor: "#638EC6",
+		}
+	case ruleCell:
+		format, err := newFormat(rule.FontColor, rule.FillColor)
+		if err != nil {
+			return err
+		}
+		opts = excelize.ConditionalFormatOptions{Type: "cell", Criteria: rule.Criteria, Value: rule.Value, Format: format}
+	default:
+		return fmt.Errorf("unknown conditional format rule %q", rule.Rule)
+	}
+
+	return file.SetConditionalFormat(sheetName, rangeRef, []excelize.ConditionalFormatOptions{opts})
+}
+
+// addChart draws a chart next to the data range, with one series per value column.
+//
+// @param file: Excel file
+// @param sheetName: sheet name
+// @param columns: column names
+// @param headerRow: header row
+// @param lastRow: last data row
+// @param chartConfig: chart configuration
+// @return error: error if any
+func addChart(file *excelize.File, sheetName string, columns []string, headerRow int, lastRow int, chartConfig *ChartConfig) error {
+	chartType, ok := chartTypes[chartConfig.Type]
+	if !ok {
+		return fmt.Errorf("unsupported chart type %q", chartConfig.Type)
+	}
+
+	sheetRef := "'" + strings.ReplaceAll(sheetName, "'", "''") + "'"
+	columnRange := func(colIndex, fromRow, toRow int) string {
+		column, _ := excelize.ColumnNumberToName(colIndex + 1)
+		return fmt.Sprintf("%s!$%s$%d:$%s$%d", sheetRef, column, fromRow, column, toRow)
+	}
+
+	categoryIndex := columnIndex(columns, chartConfig.Category)
+	series := make([]excelize.ChartSeries, 0, len(chartConfig.Values))
+	for _, value := range chartConfig.Values {
+		valueIndex := columnIndex(columns, value)
+		column, _ := excelize.ColumnNumberToName(valueIndex + 1)
+		series = append(series, excelize.ChartSeries{
+			Name:       fmt.Sprintf("%s!$%s$%d", sheetRef, column, headerRow),
+			Categories: columnRange(categoryIndex, headerRow+1, lastRow),
+			Values:     columnRange(valueIndex, headerRow+1, lastRow),
+		})
+	}
+
+	chart := &excelize.Chart{
+		Type:   chartType,
+		Series: series,
+		Legend: excelize.ChartLegend{Position: "bottom"},
+	}
+	if chartConfig.Title != "" {
+		chart.Title = []excelize.RichTextRun{{Text: chartConfig.Title}}
+	}
+
+	// Place the chart one column to the right of the data
+	cell, _ := excelize.CoordinatesToCellName(len(columns)+2, headerRow)
+	return file.AddChart(sheetName, cell, chart)
+}
+
+// exportTable exports a table once and writes it into every configured format.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return []Attachment: one attachment per format
+// @return error: error if any
+func exportTable(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) ([]Attachment, error) {
+	formats := attachmentConfig.formats()
+	logInfof("Starting to export table %s as %s", attachmentConfig.Table, strings.Join(formats, ", "))
+	if attachmentConfig.PageSize > 0 {
+		return exportPagedTable(ctx, db, attachmentConfig)
+	}
+
+	var result *ResultSet
+	err := retryExport(ctx, attachmentConfig, func() error {
+		var err error
+		result, err = queryTable(ctx, db, attachmentConfig)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	attachmentConfig.Excel, err = resolveFileName(attachmentConfig.Excel, result)
+	if err != nil {
+		log.Printf("Failed to resolve file name of table %s: %v", attachmentConfig.Table, err)
+		return nil, err
+	}
+
+	attachments := make([]Attachment, 0, len(formats))
+	for _, format := range formats {
+		var buffer *bytes.Buffer
+		var mimeType string
+		switch format {
+		case formatXLSX:
+			buffer, err = writeExcel(result, attachmentConfig)
+			mimeType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case formatCSV:
+			buffer, err = writeCSV(result, attachmentConfig)
+			mimeType = "text/csv; charset=utf-8"
+		case formatSQLite:
+			buffer, err = writeSQLite(result, attachmentConfig)
+			mimeType = "application/vnd.sqlite3"
+		default:
+			err = fmt.Errorf("unsupported attachment format %q", format)
+		}
+		if err != nil {
+			log.Printf("Failed to write table %s as %s: %v", attachmentConfig.Table, format, err)
+			return nil, err
+		}
+
+		attachments = append(attachments, Attachment{
+			fileName: attachmentConfig.fileName(format),
+			mimeType: mimeType,
+			file:     buffer,
+			rows:     len(result.Rows),
+			result:   result,
+		})
+	}
+
+	logInfof("Successfully exported table %s", attachmentConfig.Table)
+	return attachments, nil
+}
+
+// exportRetryDelay is the pause before retrying a failed export.
+const exportRetryDelay = 2 * time.Second
+
+// retryExport runs the query of an export, running it again up to
+// export_retries times while it fails for a reason that may pass. The pause
+// between attempts ends early when the run is cancelled.
+//
+// @param ctx: run context
+// @param attachmentConfig: table attachment configuration
+// @param query: function running the query
+// @return error: error of the last attempt
+func retryExport(ctx context.Context, attachmentConfig TableAttachmentConfig, query func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := query()
+		if err == nil || attempt > attachmentConfig.ExportRetries || ctx.Err() != nil || !retryableExportError(err) {
+			return err
+		}
+		log.Printf("Failed to query table %s, retrying in %s (%d/%d): %v", attachmentConfig.Table, exportRetryDelay, attempt, attachmentConfig.ExportRetries, err)
+		if err := sleepContext(ctx, exportRetryDelay); err != nil {
+			return err
+		}
+	}
+}
+
+// retryableExportError reports whether a query failed for a reason that may
+// pass, such as a dropped or refused connection or a network timeout, rather
+// than because of the query or the data. Query timeouts are not retried.
+//
+// @param err: query error
+// @return bool: true if the query may be retried
+func retryableExportError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var dmErr *dm.DmError
+	return errors.As(err, &dmErr) && dmErr.ErrCode == dm.ECGO_COMMUNITION_ERROR.ErrCode
+}
+
+// resolveTemplateCell resolves a defined name or cell reference in the template
+// workbook to a sheet name and cell. Plain cell references such as "B2" refer to
+// the first sheet; "Sheet1!B2" selects the sheet explicitly.
+//
+// @param file: template workbook
+// @param ref: defined name or cell reference
+// @return string: sheet name
+// @return string: cell name
+// @return error: error if the reference cannot be resolved
+func resolveTemplateCell(file *excelize.File, ref string) (string, string, error) {
+	target := ref
+	for _, definedName := range file.GetDefinedName() {
+		if definedName.Name == ref {
+			target = definedName.RefersTo
+			break
+		}
+	}
+
+	sheetName := file.GetSheetName(0)
+	cell := target
+	if i := strings.LastIndex(target, "!"); i >= 0 {
+		sheetName = strings.Trim(target[:i], "'")
+		cell = target[i+1:]
+	}
+
+	// Use the top-left cell of a range and drop absolute markers
+	cell = strings.ReplaceAll(strings.SplitN(cell, ":", 2)[0], "$", "")
+
+	if index, err := file.GetSheetIndex(sheetName); err != nil || index < 0 {
+		return "", "", fmt.Errorf("named range or cell %q not found in template", ref)
+	}
+	if _, _, err := excelize.CellNameToCoordinates(cell); err != nil {
+		return "", "", fmt.Errorf("named range or cell %q not found in template", ref)
+	}
+
+	return sheetName, cell, nil
+}
+
+// exportTemplateToExcel fills a template workbook with the results of single-value
+// queries, each written into the named range or cell it is mapped to.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return *bytes.Buffer: Excel file buffer
+// @return error: error if any
+func exportTemplateToExcel(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) (*bytes.Buffer, error) {
+	logInfof("Starting to fill Excel template %s", attachmentConfig.Template)
+
+	file, err := excelize.OpenFile(attachmentConfig.Template)
+	if err != nil {
+		log.Printf("Failed to open Excel template: %v", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	// Sort the references so the cells are filled in a stable order
+	refs := make([]string, 0, len(attachmentConfig.Cells))
+	for ref := range attachmentConfig.Cells {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	// Validate every reference before running any query
+	sheets := make(map[string]string, len(refs))
+	cells := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		sheetName, cell, err := resolveTemplateCell(file, ref)
+		if err != nil {
+			log.Printf("Invalid template reference: %v", err)
+			return nil, err
+		}
+		sheets[ref] = sheetName
+		cells[ref] = cell
+	}
+
+	for _, ref := range refs {
+		query := attachmentConfig.Cells[ref]
+
+		var value sql.NullString
+		ctx, cancel := attachmentConfig.queryContext(ctx)
+		err := db.QueryRowContext(ctx, query).Scan(&value)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to query value for %s: %v", ref, err)
+			return nil, err
+		}
+
+		var cellValue interface{} = "NULL"
+		if value.Valid {
+			cellValue = value.String
+			if number, err := strconv.ParseFloat(value.String, 64); err == nil {
+				cellValue = number
+			}
+		}
+
+		if err := file.SetCellValue(sheets[ref], cells[ref], cellValue); err != nil {
+			log.Printf("Failed to write value for %s: %v", ref, err)
+			return nil, err
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := file.Write(buffer); err != nil {
+		log.Printf("Failed to write Excel file to buffer: %v", err)
+		return nil, err
+	}
+
+	logInfof("Successfully filled Excel template %s", attachmentConfig.Template)
+	return buffer, nil
+}
+
+// exportQueriesToExcel writes the results of several queries one below the
+// other into a single sheet. Each block starts with its label, if any, and its
+// own header row, and blocks are separated by an empty row.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return *bytes.Buffer: Excel file buffer
+// @return int: number of data rows of all queries
+// @return error: error if any
+func exportQueriesToExcel(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) (*bytes.Buffer, int, error) {
+	logInfof("Starting to export %d queries to %s", len(attachmentConfig.Queries), attachmentConfig.Excel)
+
+	file := excelize.NewFile()
+	defer file.Close()
+	sheetName := file.GetSheetName(0)
+
+	labelStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err != nil {
+		log.Printf("Failed to create label style: %v", err)
+		return nil, 0, err
+	}
+
+	rowNum, rows := 1, 0
+	for i, queryConfig := range attachmentConfig.Queries {
+		source := fmt.Sprintf("query #%d", i+1)
+		if queryConfig.Label != "" {
+			source = fmt.Sprintf("query %q", queryConfig.Label)
+		}
+
+		result, err := runQuery(ctx, db, queryConfig.Query, source, attachmentConfig)
+		if err != nil {
+			return nil, 0, err
+		}
+		rows += len(result.Rows)
+
+		if i > 0 {
+			rowNum++
+		}
+		if queryConfig.Label != "" {
+			cell, _ := excelize.CoordinatesToCellName(1, rowNum)
+			file.SetCellValue(sheetName, cell, queryConfig.Label)
+			file.SetCellStyle(sheetName, cell, cell, labelStyle)
+			rowNum++
+		}
+
+		for colNum, colName := range result.Columns {
+			cell, _ := excelize.CoordinatesToCellName(colNum+1, rowNum)
+			file.SetCellValue(sheetName, cell, colName)
+		}
+		rowNum++
+
+		for _, row := range result.Rows {
+			for colNum, value := range row {
+				cell, _ := excelize.CoordinatesToCellName(colNum+1, rowNum)
+				if value == nil {
+					file.SetCellValue(sheetName, cell, "NULL")
+				} else {
+					file.SetCellValue(sheetName, cell, string(value))
+				}
+			}
+			rowNum++
+		}
+	}
+
+	buffer := new(bytes.Buffer)
+	if err := file.Write(buffer); err != nil {
+		log.Printf("Failed to write Excel file to buffer: %v", err)
+		return nil, 0, err
+	}
+
+	logInfof("Successfully exported queries to %s", attachmentConfig.Excel)
+	return buffer, rows, nil
+}
+
+// createDMDB creates a connection to the DM database.
+//
+// @param username: database username
+// @param password: database password
+// @param host: database host
+// @param port: database port
+// @param params: additional DSN parameters
+// @return *sql.DB: database connection
+// @return error: error if any
+func createDMDB(username string, password string, host string, port string, params url.Values) (*sql.DB, error) {
+	logInfoln("Attempting to connect to the DM database...")
+
+	if username == "" || password == "" || host == "" || port == "" {
+		err := fmt.Errorf("invalid database credentials or host information")
+		log.Printf("Failed to connect: %v", err)
+		return nil, err
+	}
+
+	dataSourceName := fmt.Sprintf("dm://%s:%s@%s:%s", username, password, host, port)
+	if len(params) > 0 {
+		dataSourceName += "?" + params.Encode()
+	}
+
+	db, err := sql.Open("dm", dataSourceName)
+	if err != nil {
+		log.Printf("Failed to open database connection: %v", err)
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		log.Printf("Failed to ping database: %v", err)
+		db.Close()
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(5)
+	db.SetConnMaxLifetime(0)
+
+	logInfoln("DM database connection established successfully.")
+	return db, nil
+}
+
+// readPasswordFile resolves a password that may be supplied through a secret file,
+// such as a Docker or Kubernetes secret mount. Trailing newlines are trimmed.
+//
+// @param password: inline password
+// @param passwordFile: password file path
+// @return string: resolved password
+// @return error: error if any
+func readPasswordFile(password string, passwordFile string) (string, error) {
+	if passwordFile == "" {
+		return password, nil
+	}
+	if password != "" {
+		return "", fmt.Errorf("both password and password_file are set")
+	}
+
+	data, err := os.ReadFile(passwordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// resolveEmailPasswords reads the password files of an email configuration and
+// its fallback servers.
+//
+// @param email: email configuration
+// @return error: error if any
+func resolveEmailPasswords(email *EmailConfig) error {
+	var err error
+	if email.Password, err = readPasswordFile(email.Password, email.PasswordFile); err != nil {
+		return err
+	}
+	for i := range email.Servers {
+		server := &email.Servers[i]
+		if server.Password, err = readPasswordFile(server.Password, server.PasswordFile); err != nil {
+			return fmt.Errorf("server %s: %w", server.Host, err)
+		}
+	}
+	return nil
+}
+
+// resolvePasswords replaces password_file references in the configuration with
+// the secrets read from those files.
+//
+// @param config: configuration
+// @return error: error if any
+func resolvePasswords(config *Config) error {
+	var err error
+	if err = resolveEmailPasswords(&config.Email); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	for name, profile := range config.EmailProfiles {
+		if err = resolveEmailPasswords(&profile); err != nil {
+			return fmt.Errorf("email profile %s: %w", name, err)
+		}
+		config.EmailProfiles[name] = profile
+	}
+	if config.DB.Password, err = readPasswordFile(config.DB.Password, config.DB.PasswordFile); err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	for name, dbConfig := range config.Databases {
+		if dbConfig.Password, err = readPasswordFile(dbConfig.Password, dbConfig.PasswordFile); err != nil {
+			return fmt.Errorf("database %s: %w", name, err)
+		}
+		config.Databases[name] = dbConfig
+	}
+	return nil
+}
+
+// readConfig reads the configuration from the given file path.
+//
+// @param configPath: configuration file path
+// @return *Config: configuration
+func readConfig(configPath string) (*Config, error) {
+	logInfof("Reading configuration from: %s", configPath)
+
+	file, err := os.Open(configPath)
+	if err != nil {
+		log.Printf("Failed to open config file: %v", err)
+		return nil, err
+	}
+	defer file.Close()
+
+	var config Config
+
+	decoder := json.NewDecoder(file)
+	if err = decoder.Decode(&config); err != nil {
+		log.Printf("Failed to decode config file: %v", err)
+		return nil, err
+	}
+
+	if err = resolvePasswords(&config); err != nil {
+		log.Printf("Failed to resolve passwords: %v", err)
+		return nil, err
+	}
+
+	applyScheduleOverride(&config)
+	applyDefaultFormats(&config)
+
+	logInfoln("Configuration file read successfully.")
+	return &config, nil
+}
+
+// applyDefaultFormats sets the formats of the attachments that name none to the
+// default_formats of their post, or else to the global default_formats.
+//
+// @param config: configuration
+func applyDefaultFormats(config *Config) {
+	for i := range config.Post {
+		post := &config.Post[i]
+		formats := post.DefaultFormats
+		if len(formats) == 0 {
+			formats = config.DefaultFormats
+		}
+		if len(formats) == 0 {
+			continue
+		}
+		for j := range post.Attachment {
+			if len(post.Attachment[j].Formats) == 0 {
+				post.Attachment[j].Formats = formats
+			}
+		}
+	}
+}
+
+// sendHeartbeat sends a small email confirming that the scheduled run has started.
+//
+// @param config: configuration
+// @return error: error if any
+func sendHeartbeat(config Config) error {
+	heartbeat := config.Heartbeat
+	logInfof("Sending heartbeat email to: %s", heartbeat.To)
+
+	subject := heartbeat.Subject
+	if subject == "" {
+		subject = "DMDataPushMailer heartbeat"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	body := fmt.Sprintf("Scheduled run started at %s on host %s.", time.Now().Format(time.RFC3339), hostname)
+
+	return SendEmail(config.Email.smtpServers(), Email{
+		From:       heartbeat.From,
+		To:         []string{heartbeat.To},
+		Subject:    subject,
+		Body:       body,
+		ReturnPath: config.Email.Bounce,
+	})
+}
+
+// sendFailureNotification emails the administrator that a run failed after all
+// retries. The error names the failing posts.
+//
+// @param config: configuration
+// @param attempts: number of attempts made
+// @param taskErr: error of the last attempt
+// @param exports: attachments exported during the run
+// @param attachments: attachments of the notification
+// @return error: error if any
+func sendFailureNotification(config Config, attempts int, taskErr error, exports []ExportRecord, attachments []Attachment) error {
+	admin := config.AdminEmail
+	logInfof("Sending failure notification to: %s", admin.To)
+
+	subject := admin.Subject
+	if subject == "" {
+		subject = "DMDataPushMailer run failed"
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	body := fmt.Sprintf("The scheduled run on host %s failed at %s after %d attempt(s).\r\n\r\nError:\r\n%v",
+		hostname, time.Now().Format(time.RFC3339), attempts, taskErr)
+	if len(exports) > 0 {
+		body += "\r\n\r\n" + formatExportRecords(exports)
+	}
+
+	return SendEmail(config.Email.smtpServers(), Email{
+		From:        admin.From,
+		To:          []string{admin.To},
+		Subject:     subject,
+		Body:        body,
+		Attachments: attachments,
+		ReturnPath:  config.Email.Bounce,
+	})
+}
+
+// sendRunSummary emails the administrator a summary of a successful run, with
+// the time taken, rows and size of each exported attachment.
+//
+// @param config: configuration
+// @param attempts: number of attempts made
+// @param exports: attachments exported during the run
+// @param attachments: attachments of the summary
+// @return error: error if any
+func sendRunSummary(config Config, attempts int, exports []ExportRecord, attachments []Attachment) error {
+	admin := config.AdminEmail
+	logInfof("Sending run summary to: %s", admin.To)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	body := fmt.Sprintf("The scheduled run on host %s completed at %s after %d attempt(s).\r\n\r\n%s",
+		hostname, time.Now().Format(time.RFC3339), attempts, formatExportRecords(exports))
+
+	return SendEmail(config.Email.smtpServers(), Email{
+		From:        admin.From,
+		To:          []string{admin.To},
+		Subject:     "DMDataPushMailer run summary",
+		Body:        body,
+		Attachments: attachments,
+		ReturnPath:  config.Email.Bounce,
+	})
+}
+
+// readFileAttachment reads a static file from disk as an attachment. The MIME
+// type is inferred from the file extension.
+//
+// @param attachmentConfig: attachment configuration
+// @return Attachment: file attachment
+// @return error: error if any
+func readFileAttachment(attachmentConfig TableAttachmentConfig) (Attachment, error) {
+	logInfof("Reading file attachment %s", attachmentConfig.File)
+
+	data, err := os.ReadFile(attachmentConfig.File)
+	if err != nil {
+		log.Printf("Failed to read file attachment: %v", err)
+		return Attachment{}, err
+	}
+
+	fileName := attachmentConfig.Excel
+	if fileName == "" {
+		fileName = filepath.Base(attachmentConfig.File)
+	}
+
+	mimeType := mime.TypeByExtension(filepath.Ext(fileName))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+
+	return Attachment{
+		fileName: fileName,
+		mimeType: mimeType,
+		file:     bytes.NewBuffer(data),
+	}, nil
+}
+
+// exportAttachment produces the attachments for a single attachment configuration,
+// from a template, a static file or a table export.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param cache: export cache of the run, nil to export every table
+// @param attachmentConfig: attachment configuration
+// @return []Attachment: produced attachments
+// @return error: error if any
+func exportAttachment(ctx context.Context, db queryer, cache *exportCache, attachmentConfig TableAttachmentConfig) ([]Attachment, error) {
+	if len(attachmentConfig.UnionTables) > 0 {
+		var err error
+		if attachmentConfig.Table, err = unionSource(ctx, db, attachmentConfig); err != nil {
+			log.Printf("Failed to combine tables %s: %v", strings.Join(attachmentConfig.UnionTables, ", "), err)
+			return nil, err
+		}
+	}
+
+	var exported []Attachment
+	switch {
+	case attachmentConfig.Template != "":
+		attachment, err := exportTemplateToExcel(ctx, db, attachmentConfig)
+		if err != nil {
+			log.Printf("Failed to fill Excel template %s: %v", attachmentConfig.Template, err)
+			return nil, err
+		}
+		exported = []Attachment{{
+			fileName: attachmentConfig.Excel,
+			mimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+			file:     attachment,
+		}}
+	case len(attachmentConfig.Queries) > 0:
+		attachment, rows, err := exportQueriesToExcel(ctx, db, attachmentConfig)
+		if err != nil {
+			log.Printf("Failed to export queries to %s: %v", attachmentConfig.Excel, err)
+			return nil, err
+		}
+		exported = []Attachment{{
+			fileName: attachmentConfig.Excel,
+			mimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+			file:     attachment,
+			rows:     rows,
+		}}
+	case attachmentConfig.SchemaOnly:
+		attachment, err := exportTableSchema(ctx, db, attachmentConfig)
+		if err != nil {
+			log.Printf("Failed to export schema of table %s: %v", attachmentConfig.Table, err)
+			return nil, err
+		}
+		exported = []Attachment{attachment}
+	case attachmentConfig.File != "":
+		attachment, err := readFileAttachment(attachmentConfig)
+		if err != nil {
+			return nil, err
+		}
+		exported = []Attachment{attachment}
+	default:
+		var err error
+		exported, err = cache.exportTable(ctx, db, attachmentConfig)
+		if err != nil {
+			log.Printf("Failed to export table %s: %v", attachmentConfig.Table, err)
+			return nil, err
+		}
+	}
+
+	if len(attachmentConfig.TransformCmd) > 0 {
+		for i := range exported {
+			transformed, err := transformAttachment(ctx, attachmentConfig, exported[i])
+			if err != nil {
+				return nil, err
+			}
+			exported[i] = transformed
+		}
+	}
+
+	if attachmentConfig.MimeType != "" {
+		for i := range exported {
+			exported[i].mimeType = attachmentConfig.MimeType
+		}
+	}
+
+	if attachmentConfig.AttachQuery && attachmentConfig.File == "" {
+		// Name the query after the exported file, whose name may be resolved from the data
+		exported = append(exported, Attachment{
+			fileName: sqlFileName(exported[0].fileName),
+			mimeType: "application/sql",
+			file:     bytes.NewBufferString(attachmentConfig.queryText()),
+		})
+	}
+
+	return exported, nil
+}
+
+// resolveRecipients merges the static recipients of a post with the addresses
+// of its recipients file and those returned by its recipients query. Malformed
+// addresses are skipped and duplicates removed.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param post: post configuration
+// @return []string: recipient addresses
+// @return error: error if any
+func resolveRecipients(ctx context.Context, db queryer, post PostConfig) ([]string, error) {
+	candidates := append([]string{}, post.To...)
+
+	if post.RecipientsFile != "" {
+		logInfof("Loading recipients for post %q from %s", post.Subject, post.RecipientsFile)
+
+		addresses, err := readRecipientsFile(post.RecipientsFile, post.RecipientsColumn)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, addresses...)
+	}
+
+	if post.RecipientsQuery != "" {
+		logInfof("Loading recipients for post %q from database", post.Subject)
+
+		rows, err := db.QueryContext(ctx, post.RecipientsQuery)
+		if err != nil {
+			log.Printf("Failed to query recipients: %v", err)
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var address sql.NullString
+			if err := rows.Scan(&address); err != nil {
+				log.Printf("Failed to scan recipient: %v", err)
+				return nil, err
+			}
+			if address.Valid {
+				candidates = append(candidates, address.String)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Error during recipient iteration: %v", err)
+			return nil, err
+		}
+	}
+
+	return normalizeRecipients(candidates), nil
+}
+
+// normalizeRecipients trims and deduplicates recipient addresses, skipping malformed ones.
+//
+// @param candidates: candidate addresses
+// @return []string: valid unique addresses in their original order
+func normalizeRecipients(candidates []string) []string {
+	recipients := make([]string, 0, len(candidates))
+	seen := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		address := strings.TrimSpace(candidate)
+		parsed, err := mail.ParseAddress(address)
+		if err != nil || parsed.Address != address {
+			log.Printf("Skipping malformed recipient address %q", candidate)
+			continue
+		}
+
+		key := strings.ToLower(address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		recipients = append(recipients, address)
+	}
+	return recipients
+}
+
+// processPost exports the attachments of a single post and sends it to its recipients.
+//
+// @param ctx: run context
+// @param config: configuration
+// @param db: database connection
+// @param cache: export cache of the run
+// @param state: persisted state
+// @param statePath: state file path
+// @param breaker: SMTP circuit breaker of the run
+// @param report: delivery report of the run
+// @param post: post configuration
+// @param key: stable identifier of the post, keying its state kept between runs
+// @return error: error if any
+func processPost(ctx context.Context, config Config, dbs *Databases, cache *exportCache, state *State, statePath string, breaker *CircuitBreaker, report *DeliveryReport, post PostConfig, key string) error {
+	if reason := post.skipReason(time.Now()); reason != "" {
+		logInfof("Skipping post %q: %s", post.Subject, reason)
+		return nil
+	}
+
+	// With consistent_snapshot, all queries of the post read the same point in time
+	readers := &postReaders{ctx: ctx, dbs: dbs, snapshot: post.ConsistentSnapshot}
+	defer readers.release()
+	// Exports of other posts are read outside the snapshot, so they are not reused
+	if post.ConsistentSnapshot {
+		cache = nil
+	}
+
+	// Refresh materialized views before any snapshot is taken
+	for _, attachmentConfig := range post.Attachment {
+		if !attachmentConfig.Refresh {
+			continue
+		}
+		db, err := dbs.get(ctx, attachmentConfig.Database)
+		if err != nil {
+			return err
+		}
+		if attachmentConfig.QueryTimeout == 0 {
+			attachmentConfig.QueryTimeout = config.QueryTimeout
+		}
+		if err := refreshMaterializedView(ctx, db, attachmentConfig); err != nil {
+			return err
+		}
+	}
+
+	attachments := make([]Attachment, 0)
+	sheets := make([]combinedSheet, 0)
+	// Hashes of the attachments that opted into send_if_changed, keyed by the
+	// post identifier and the configured file name, before any template in it is
+	// resolved, so that the key stays the same from run to run
+	hashes := make(map[string]string)
+	changed := false
+	for _, attachmentConfig := range post.orderedAttachments() {
+		reader, err := readers.get(attachmentConfig.Database)
+		if err != nil {
+			return err
+		}
+
+		if attachmentConfig.QueryTimeout == 0 {
+			attachmentConfig.QueryTimeout = config.QueryTimeout
+		}
+		if attachmentConfig.MaxLOBLength == 0 {
+			attachmentConfig.MaxLOBLength = config.MaxLOBLength
+		}
+		// The combined workbook writes every table to Excel cells
+		if attachmentConfig.MaxLOBLength == 0 && post.CombinedWorkbook != "" {
+			attachmentConfig.MaxLOBLength = defaultMaxLOBLength
+		}
 
-	encoder := base64.NewEncoder(base64.StdEncoding, part)
-	defer encoder.Close()
+		start := time.Now()
+		exported, err := exportAttachment(ctx, reader, cache, attachmentConfig)
+		if err != nil {
+			return err
+		}
+		duration := time.Since(start)
 
-	_, err = io.Copy(encoder, attachment)
-	if err != nil {
-		log.Printf("Failed to write attachment: %v", err)
-		return err
-	}
+		// The Google Sheet is a sink of its own, written from the rows of the export
+		if sheet := attachmentConfig.GoogleSheet; sheet != nil && len(exported) > 0 && exported[0].result != nil {
+			if err := writeGoogleSheet(ctx, sheet, exported[0].result); err != nil {
+				return err
+			}
+			if sheet.SinkOnly {
+				logInfof("Wrote table %s of post %q to Google Sheet %s only, not attaching it", attachmentConfig.Table, post.Subject, sheet.SpreadsheetID)
+				continue
+			}
+		}
+		for _, attachment := range exported {
+			logInfof("Exported %s of post %q: %d rows, %d bytes in %s", attachment.fileName, post.Subject, attachment.rows, attachment.file.Len(), duration)
+			report.addExport(post.Subject, attachment, duration)
+		}
 
-	log.Printf("Attachment %s written successfully.", fileName)
-	return nil
-}
+		encoding := attachmentConfig.Encoding
+		if encoding == "" {
+			encoding = config.AttachmentEncoding
+		}
+		for i := range exported {
+			exported[i].encoding = encoding
+		}
 
-// SendEmail sends an email with attachments.
-//
-// @param smtpServer: SMTP server address
-// @param port: SMTP server port
-// @param username: SMTP server username
-// @param password: SMTP server password
-// @param from: email sender
-// @param to: email recipient
-// @param subject: email subject
-// @param body: email body
-// @param attachments: email attachments
-// @return error: error if any
-func SendEmail(
-	smtpServer string,
-	port string,
-	username string,
-	password string,
-	from string,
-	to string,
-	subject string,
-	body string,
-	attachments []Attachment) error {
-
-	log.Printf("Starting to prepare email to: %s", to)
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
-	defer writer.Close()
+		if attachmentConfig.SendIfChanged {
+			fileNames := attachmentConfig.fileNames()
+			for i, attachment := range exported {
+				fileName := attachment.fileName
+				if i < len(fileNames) {
+					fileName = fileNames[i]
+				}
+				hashKey := key + "/" + fileName
+				sum := sha256.Sum256(attachment.file.Bytes())
+				hashes[hashKey] = hex.EncodeToString(sum[:])
+				if state.hash(hashKey) != hashes[hashKey] {
+					changed = true
+				}
+			}
+		}
 
-	headers := map[string]string{
-		"From":         from,
-		"To":           to,
-		"Subject":      subject,
-		"MIME-Version": "1.0",
-		"Content-Type": fmt.Sprintf("multipart/mixed; boundary=%s", writer.Boundary()),
+		if post.CombinedWorkbook != "" && len(exported) > 0 && exported[0].result != nil {
+			sheets = append(sheets, combinedSheet{name: exported[0].fileName, result: exported[0].result, config: attachmentConfig})
+		}
+
+		attachments = append(attachments, exported...)
 	}
-	for key, value := range headers {
-		buf.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+
+	if len(hashes) > 0 && !changed {
+		logInfof("Skipping post %q: data unchanged since last run", post.Subject)
+		return nil
 	}
-	buf.WriteString("\r\n")
 
-	if err := writeBody(writer, body); err != nil {
-		log.Printf("Failed to write email body: %v", err)
-		return err
+	if post.CSVZip != "" {
+		archive, err := zipAttachments(post.CSVZip, attachments)
+		if err != nil {
+			log.Printf("Failed to create archive %s: %v", post.CSVZip, err)
+			return err
+		}
+		archive.encoding = config.AttachmentEncoding
+		attachments = []Attachment{archive}
 	}
 
-	for _, attachment := range attachments {
-		if err := writeAttachment(writer, attachment.file, attachment.fileName, attachment.mimeType); err != nil {
-			log.Printf("Failed to write attachment: %v", err)
+	// The combined workbook reuses the rows already read for the table exports
+	if post.CombinedWorkbook != "" && len(sheets) > 0 {
+		workbook, err := writeCombinedWorkbook(post.CombinedWorkbook, sheets)
+		if err != nil {
 			return err
 		}
+		workbook.encoding = config.AttachmentEncoding
+		report.addExport(post.Subject, workbook, 0)
+		attachments = append(attachments, workbook)
 	}
 
-	serverAddress := fmt.Sprintf("%s:%s", smtpServer, port)
-	conn, err := tls.Dial("tcp", serverAddress, &tls.Config{InsecureSkipVerify: false})
+	// The default database is only needed for a recipients query
+	var reader queryer
+	if post.RecipientsQuery != "" {
+		var err error
+		if reader, err = readers.get(""); err != nil {
+			return err
+		}
+	}
+	recipients, err := resolveRecipients(ctx, reader, post)
 	if err != nil {
-		log.Printf("Failed to connect to SMTP server: %v", err)
 		return err
 	}
-	defer conn.Close()
 
-	client, err := smtp.NewClient(conn, smtpServer)
-	if err != nil {
-		log.Printf("Failed to create SMTP client: %v", err)
-		return err
+	// The data has been read, release the snapshot before sending
+	readers.release()
+	if len(recipients) == 0 {
+		log.Printf("Post %q has no valid recipients", post.Subject)
 	}
-	defer client.Close()
 
-	auth := smtp.PlainAuth("", username, password, smtpServer)
-	if err = client.Auth(auth); err != nil {
-		log.Printf("SMTP authentication failed: %v", err)
-		return err
+	// Checksums cover uploaded attachments too, so they are computed first
+	var checksums map[string]string
+	allAttachments := attachments
+	if post.Checksums || post.ChecksumHeader {
+		checksums = attachmentChecksums(attachments)
 	}
 
-	if err = client.Mail(from); err != nil {
-		log.Printf("Failed to set sender: %v", err)
-		return err
+	body := post.Body
+	var uploaded []uploadedFile
+	if config.Upload != nil && config.Upload.URL != "" && len(recipients) > 0 {
+		if attachments, uploaded, err = uploadLargeAttachments(ctx, config.Upload, attachments); err != nil {
+			log.Printf("Failed to upload attachments of post %q: %v", post.Subject, err)
+			return err
+		}
 	}
-	if err = client.Rcpt(to); err != nil {
-		log.Printf("Failed to set recipient: %v", err)
-		return err
+
+	// send sends the post to the recipients and returns those who were rejected
+	send := func(recipients []string) ([]string, error) {
+		rejected := make([]string, 0)
+		for _, recipient := range recipients {
+			if state.delivered(key, recipient) {
+				logInfof("Skipping recipient %s: post %q already delivered in this run", recipient, post.Subject)
+				report.add(post.Subject, recipient, deliverySkipped, nil, 0, 0)
+				continue
+			}
+
+			if err := ctx.Err(); err != nil {
+				log.Printf("Not sending post %q to %s: %v", post.Subject, recipient, errRunAborted)
+				report.add(post.Subject, recipient, deliveryFailed, errRunAborted, 0, 0)
+				return rejected, errRunAborted
+			}
+			if err := breaker.allow(); err != nil {
+				log.Printf("Not sending post %q to %s: %v", post.Subject, recipient, err)
+				report.add(post.Subject, recipient, deliveryFailed, err, 0, 0)
+				return rejected, err
+			}
+
+			// Links are limited to the files the recipient may receive
+			recipientBody := appendDownloadLinks(body, uploaded, post.attachmentsFor(recipient, allAttachments))
+			headers := priorityHeaderValues(post.Priority)
+			if checksums != nil {
+				files := post.attachmentsFor(recipient, allAttachments)
+				if post.Checksums {
+					recipientBody = appendChecksums(recipientBody, files, checksums)
+				}
+				if post.ChecksumHeader && len(files) > 0 {
+					if headers == nil {
+						headers = make(map[string]string)
+					}
+					headers[checksumHeader] = checksumHeaderValue(files, checksums)
+				}
+			}
+
+			start := time.Now()
+			size, err := sendEmail(ctx, config.postServers(post), Email{
+				From:          post.From,
+				To:            []string{recipient},
+				Subject:       config.postSubject(post),
+				Body:          recipientBody,
+				Attachments:   post.attachmentsFor(recipient, attachments),
+				Headers:       headers,
+				MaxBodyLength: config.MaxBodyLength,
+				Markdown:      post.BodyType == bodyTypeMarkdown,
+				GzipBody:      config.GzipBodyAttachment,
+				ReturnPath:    config.postEmail(post).Bounce,
+			})
+
+			duration := time.Since(start)
+
+			var recipientErr *RecipientError
+			if errors.As(err, &recipientErr) {
+				// The server is working, it only refused this recipient
+				breaker.record(nil)
+				log.Printf("Skipping rejected recipient %s: %v", recipient, err)
+				report.add(post.Subject, recipient, deliveryRejected, err, 0, duration)
+				rejected = append(rejected, recipient)
+				continue
+			}
+			breaker.record(err)
+			if err != nil {
+				log.Printf("Failed to send email to %s: %v", recipient, err)
+				report.add(post.Subject, recipient, deliveryFailed, err, 0, duration)
+				return rejected, err
+			}
+
+			logInfof("Email sent to %s successfully", recipient)
+			report.add(post.Subject, recipient, deliverySent, nil, size, duration)
+			if err := state.markDelivered(statePath, key, recipient); err != nil {
+				log.Printf("Failed to save state: %v", err)
+			}
+		}
+		return rejected, nil
 	}
 
-	writerClient, err := client.Data()
+	rejected, err := send(recipients)
 	if err != nil {
-		log.Printf("Failed to start email data transfer: %v", err)
 		return err
 	}
+	// Rejections may be temporary, such as a full mailbox; resend only to those
+	// recipients, reusing the attachments already generated
+	for pass := 1; pass <= config.RejectedRetries && len(rejected) > 0; pass++ {
+		logInfof("Retrying post %q for %d rejected recipient(s) in %d second(s) (%d/%d)", post.Subject, len(rejected), config.RejectedRetryDelay, pass, config.RejectedRetries)
+		if err := sleepContext(ctx, time.Duration(config.RejectedRetryDelay)*time.Second); err != nil {
+			return errRunAborted
+		}
+		if rejected, err = send(rejected); err != nil {
+			return err
+		}
+	}
 
-	if _, err = writerClient.Write(buf.Bytes()); err != nil {
-		log.Printf("Failed to send email data: %v", err)
-		return err
+	if len(hashes) > 0 {
+		if err := state.updateHashes(statePath, hashes); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
 	}
-	log.Printf("Successfully sent email to: %s", to)
 
-	return writerClient.Close()
+	return nil
 }
 
-// exportTableToExcel exports a table from the database to an Excel file.
+// task is the main task that sends emails with attachments. Posts are processed
+// by a bounded pool of workers; failures are collected and returned together.
+// A fresh run forgets the recipients delivered by the previous run, while a
+// resumed run skips them.
 //
-// @param db: database connection
-// @param tableName: table name to export
-// @return *bytes.Buffer: Excel file buffer
+// @param ctx: run context
+// @param config: configuration
+// @param resume: whether this run retries a failed run
+// @param report: report collecting the exports and deliveries of the run
 // @return error: error if any
-func exportTableToExcel(db *sql.DB, tableName string) (*bytes.Buffer, error) {
-	log.Printf("Starting to export table %s to Excel", tableName)
+func task(ctx context.Context, config Config, resume bool, report *DeliveryReport) error {
+	logInfoln("Starting task...")
 
-	file := excelize.NewFile()
-	sheetName := "Sheet1"
-	index, err := file.NewSheet(sheetName)
-	if err != nil {
-		log.Printf("Failed to create Excel sheet: %v", err)
-		return nil, err
+	if config.Heartbeat != nil && config.Heartbeat.To != "" {
+		if err := sendHeartbeat(config); err != nil {
+			log.Printf("Failed to send heartbeat email: %v", err)
+		}
 	}
 
-	query := fmt.Sprintf("SELECT * FROM %s", tableName)
-	rows, err := db.Query(query)
+	dbs, err := openDatabases(ctx, config)
 	if err != nil {
-		log.Printf("Failed to query table %s: %v", tableName, err)
-		return nil, err
+		log.Printf("Failed to connect to the database: %v", err)
+		return err
 	}
-	defer rows.Close()
+	defer dbs.Close()
 
-	columns, err := rows.Columns()
+	// A run terminated for exceeding max_run_seconds loses its connections
+	stop := context.AfterFunc(ctx, dbs.Close)
+	defer stop()
+
+	statePath := config.StateFile
+	if statePath == "" {
+		statePath = defaultStateFile
+	}
+	state, err := loadState(statePath)
 	if err != nil {
-		log.Printf("Failed to get columns from table %s: %v", tableName, err)
-		return nil, err
+		log.Printf("Failed to load state, treating all data as changed: %v", err)
+		state = newState()
 	}
-
-	for i, colName := range columns {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
-		file.SetCellValue(sheetName, cell, colName)
+	if state.mode, err = config.fileMode(); err != nil {
+		log.Printf("Failed to parse file mode: %v", err)
+		return err
+	}
+	if !resume {
+		if err := state.clearDelivered(statePath); err != nil {
+			log.Printf("Failed to clear delivered recipients: %v", err)
+		}
 	}
 
-	values := make([]sql.RawBytes, len(columns))
-	scanArgs := make([]interface{}, len(values))
-	for i := range values {
-		scanArgs[i] = &values[i]
+	concurrency := config.PostConcurrency
+	if concurrency < 1 {
+		concurrency = 1
 	}
 
-	rowNum := 2
-	for rows.Next() {
-		err = rows.Scan(scanArgs...)
-		if err != nil {
-			log.Printf("Failed to scan row in table %s: %v", tableName, err)
-			return nil, err
-		}
-		for colNum, value := range values {
-			cell, _ := excelize.CoordinatesToCellName(colNum+1, rowNum)
-			if value == nil {
-				file.SetCellValue(sheetName, cell, "NULL")
-			} else {
-				file.SetCellValue(sheetName, cell, string(value))
-			}
+	breaker := newCircuitBreaker(config.SMTPFailureLimit)
+	// Posts exporting the same table with the same options share one export
+	cache := newExportCache()
+	errs := make([]error, len(config.Post))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	started := 0
+	for i, post := range config.Post {
+		if !post.enabled() {
+			logInfof("Skipping post %q: disabled", post.Subject)
+			continue
 		}
-		rowNum++
-	}
 
-	if err = rows.Err(); err != nil {
-		log.Printf("Error during row iteration for table %s: %v", tableName, err)
-		return nil, err
-	}
+		// Pause between posts so they do not reach the mail server in one burst
+		if started > 0 && config.PostDelaySeconds > 0 {
+			sleepContext(ctx, time.Duration(config.PostDelaySeconds)*time.Second)
+		}
+		if ctx.Err() != nil {
+			errs[i] = fmt.Errorf("post %q: %w", post.Subject, errRunAborted)
+			break
+		}
+		started++
 
-	file.SetActiveSheet(index)
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, post PostConfig) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
 
-	buffer := new(bytes.Buffer)
-	if err := file.Write(buffer); err != nil {
-		log.Printf("Failed to write Excel file to buffer: %v", err)
-		return nil, err
+			if err := processPost(ctx, config, dbs, cache, state, statePath, breaker, report, post, config.postKey(i)); err != nil {
+				log.Printf("Failed to process post %q: %v", post.Subject, err)
+				errs[i] = fmt.Errorf("post %q: %w", post.Subject, err)
+			}
+		}(i, post)
 	}
+	wg.Wait()
 
-	if err := file.Close(); err != nil {
-		log.Printf("Failed to close Excel file: %v", err)
-		return nil, err
+	if err := errors.Join(errs...); err != nil {
+		failed := 0
+		for _, postErr := range errs {
+			if postErr != nil {
+				failed++
+			}
+		}
+		threshold, thresholdErr := config.failureThreshold(started)
+		if thresholdErr == nil && float64(failed) <= threshold {
+			log.Printf("Task completed with %d of %d post(s) failed, within the failure threshold %s: %v", failed, started, config.FailureThreshold, err)
+			return nil
+		}
+		log.Printf("Task completed with errors: %v", err)
+		return err
 	}
 
-	log.Printf("Successfully exported table %s to Excel", tableName)
-	return buffer, nil
+	logInfoln("Task completed successfully.")
+	return nil
 }
 
-// createDMDB creates a connection to the DM database.
+// runTask runs the task, retrying failed runs as configured. Retries resume the
+// failed run instead of starting over.
 //
-// @param username: database username
-// @param password: database password
-// @param host: database host
-// @param port: database port
-// @return *sql.DB: database connection
-// @return error: error if any
-func createDMDB(username string, password string, host string, port string) (*sql.DB, error) {
-	log.Println("Attempting to connect to the DM database...")
-
-	if username == "" || password == "" || host == "" || port == "" {
-		err := fmt.Errorf("invalid database credentials or host information")
-		log.Printf("Failed to connect: %v", err)
-		return nil, err
-	}
+// @param config: configuration
+// @return []DeliveryRecord: delivery records of all attempts
+// @return error: error of the last attempt, if any
+func runTask(config Config) ([]DeliveryRecord, error) {
+	report := &DeliveryReport{}
+	// limitRun returns once the attempts have stopped, so attempts is final
+	attempts := 1
+	err := limitRun(config, func(ctx context.Context) error {
+		err := task(ctx, config, false, report)
+		for ; err != nil && attempts <= config.Retries; attempts++ {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("Task failed, retrying in %d second(s) (%d/%d): %v", config.RetryDelaySeconds, attempts, config.Retries, err)
+			if sleepContext(ctx, time.Duration(config.RetryDelaySeconds)*time.Second) != nil {
+				return err
+			}
 
-	dataSourceName := fmt.Sprintf("dm://%s:%s@%s:%s", username, password, host, port)
+			err = task(ctx, config, true, report)
+		}
+		return err
+	})
+	final := report.finalRecords()
+	logDeliverySummary(final)
 
-	db, err := sql.Open("dm", dataSourceName)
-	if err != nil {
-		log.Printf("Failed to open database connection: %v", err)
-		return nil, err
+	admin := config.AdminEmail
+	var attachments []Attachment
+	if config.SummaryPDF != "" || (admin != nil && admin.SummaryPDF) {
+		pdf := runReportPDF(report, attempts, err)
+		if config.SummaryPDF != "" {
+			if writeErr := writeSummaryPDF(config, pdf); writeErr != nil {
+				log.Printf("Failed to write run report PDF: %v", writeErr)
+			}
+		}
+		if admin != nil && admin.SummaryPDF {
+			attachments = append(attachments, Attachment{
+				fileName: "run-report.pdf",
+				mimeType: "application/pdf",
+				file:     bytes.NewBuffer(pdf),
+				encoding: config.AttachmentEncoding,
+			})
+		}
 	}
 
-	if err := db.Ping(); err != nil {
-		log.Printf("Failed to ping database: %v", err)
-		db.Close()
-		return nil, err
+	if admin != nil && admin.To != "" {
+		if err != nil {
+			if notifyErr := sendFailureNotification(config, attempts, err, report.exportRecords(), attachments); notifyErr != nil {
+				log.Printf("Failed to send failure notification: %v", notifyErr)
+			}
+		} else if admin.Summary {
+			if notifyErr := sendRunSummary(config, attempts, report.exportRecords(), attachments); notifyErr != nil {
+				log.Printf("Failed to send run summary: %v", notifyErr)
+			}
+		}
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(0)
-
-	log.Println("DM database connection established successfully.")
-	return db, nil
+	if config.PostRunCommand != "" {
+		if hookErr := runPostRunCommand(config, attempts, err, final); hookErr != nil {
+			log.Printf("Post-run command failed: %v", hookErr)
+		}
+	}
+	return report.records(), err
 }
 
-// readConfig reads the configuration from the given file path.
+// describeSchedule describes when a post is sent: the cron expression with its
+// next run time, followed by the post's day filters, or "disabled".
 //
-// @param configPath: configuration file path
-// @return *Config: configuration
-func readConfig(configPath string) (*Config, error) {
-	log.Printf("Reading configuration from: %s", configPath)
-
-	file, err := os.Open(configPath)
-	if err != nil {
-		log.Printf("Failed to open config file: %v", err)
-		return nil, err
+// @param config: configuration
+// @param post: post configuration
+// @return string: schedule description
+func describeSchedule(config *Config, post PostConfig) string {
+	if !post.enabled() {
+		return "disabled"
 	}
-	defer file.Close()
 
-	var config Config
-
-	decoder := json.NewDecoder(file)
-	if err = decoder.Decode(&config); err != nil {
-		log.Printf("Failed to decode config file: %v", err)
-		return nil, err
+	schedule := config.Time
+	if parsed, err := config.parseSchedule(); err != nil {
+		schedule += " (invalid)"
+	} else {
+		schedule += fmt.Sprintf(" (next: %s)", parsed.Next(time.Now()).Format("2006-01-02 15:04"))
 	}
 
-	log.Println("Configuration file read successfully.")
-	return &config, nil
+	if post.SkipWeekends {
+		schedule += ", skip weekends"
+	}
+	if len(post.Holidays) > 0 {
+		schedule += fmt.Sprintf(", %d holiday(s)", len(post.Holidays))
+	}
+	return schedule
 }
 
-// task is the main task that sends emails with attachments.
+// listPosts prints an overview of the configured posts.
 //
+// @param out: output writer
 // @param config: configuration
-func task(config Config) {
-	log.Println("Starting task...")
-
-	db, err := createDMDB(config.DB.Username, config.DB.Password, config.DB.Host, fmt.Sprintf("%d", config.DB.Port))
-	if err != nil {
-		log.Printf("Failed to connect to the database: %v", err)
-		return
-	}
-	defer db.Close()
-
-	for _, post := range config.Post {
-		attachments := make([]Attachment, 0)
-		for _, attachmentConfig := range post.Attachment {
-			attachment, err := exportTableToExcel(db, attachmentConfig.Table)
-			if err != nil {
-				log.Printf("Failed to export table %s to Excel: %v", attachmentConfig.Table, err)
-				return
-			}
+func listPosts(out io.Writer, config *Config) {
+	writer := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "#\tSUBJECT\tFROM\tRECIPIENTS\tATTACHMENTS\tSCHEDULE")
 
-			attachments = append(attachments, Attachment{
-				fileName: attachmentConfig.Excel,
-				mimeType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-				file:     attachment,
-			})
+	for i, post := range config.Post {
+		recipients := strings.Join(post.To, ", ")
+		if post.RecipientsQuery != "" {
+			recipients = strings.TrimPrefix(recipients+", <recipients_query>", ", ")
+		}
+		if post.RecipientsFile != "" {
+			recipients = strings.TrimPrefix(recipients+", <"+post.RecipientsFile+">", ", ")
 		}
 
-		for _, recipient := range post.To {
-			err := SendEmail(
-				config.Email.Host,
-				fmt.Sprintf("%d", config.Email.Port),
-				config.Email.Username,
-				config.Email.Password,
-				post.From,
-				recipient,
-				post.Subject,
-				post.Body,
-				attachments,
-			)
-
-			if err != nil {
-				log.Printf("Failed to send email to %s: %v", recipient, err)
-				return
+		attachments := make([]string, 0, len(post.Attachment))
+		for _, attachment := range post.Attachment {
+			source := attachment.Table
+			switch {
+			case len(attachment.UnionTables) > 0:
+				source = "union " + strings.Join(attachment.UnionTables, ", ")
+			case attachment.Template != "":
+				source = "template " + attachment.Template
+			case len(attachment.Queries) > 0:
+				source = fmt.Sprintf("%d queries", len(attachment.Queries))
+			case attachment.File != "":
+				source = "file " + attachment.File
 			}
-
-			log.Printf("Email sent to %s successfully", recipient)
+			attachments = append(attachments, fmt.Sprintf("%s <- %s", strings.Join(attachment.fileNames(), "/"), source))
 		}
+
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\n",
+			i+1,
+			config.postSubject(post),
+			post.From,
+			recipients,
+			strings.Join(attachments, "; "),
+			describeSchedule(config, post),
+		)
 	}
 
-	log.Println("Task completed successfully.")
+	writer.Flush()
 }
 
 // main is the entry point of the application.
 func main() {
 	configPath := flag.String("config", "", "json config file path")
+	validate := flag.Bool("validate", false, "validate the config file and exit")
+	listPostsFlag := flag.Bool("list-posts", false, "list the configured posts and their schedule and exit")
+	quietFlag := flag.Bool("quiet", false, "only log warnings and errors")
+	initFlag := flag.Bool("init", false, "create a starter config file interactively and exit")
+	schemaFlag := flag.Bool("config-schema", false, "print the JSON Schema of the config file and exit")
+	renderFlag := flag.Bool("render", false, "print the subject, body and attachment names of each post rendered with sample data and exit")
+	renderDate := flag.String("render-date", "", "date used by -render for {{.date}} (YYYY-MM-DD), defaults to today")
+	renderRows := flag.Int("render-rows", 1, "number of sample rows used by -render; 0 renders as if the export was empty")
 	flag.Parse()
 
+	quiet = *quietFlag
+
+	if *schemaFlag {
+		if err := writeConfigSchema(os.Stdout); err != nil {
+			log.Printf("Failed to write config schema: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *initFlag {
+		path := *configPath
+		if path == "" {
+			path = "config.json"
+		}
+		if err := runInit(os.Stdin, os.Stdout, path); err != nil {
+			log.Printf("Failed to create config file: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if *configPath == "" {
 		log.Println("Config file path is empty")
+		if *validate {
+			os.Exit(1)
+		}
 		return
 	}
 
 	config, err := readConfig(*configPath)
 	if err != nil {
 		log.Printf("Failed to read config file: %v", err)
+		if *validate {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// -validate reports an invalid file_date_format along with the other issues
+	if layout, err := config.dateLayout(); err == nil {
+		fileDateLayout = layout
+	} else if !*validate {
+		log.Printf("Invalid configuration: file_date_format: %v", err)
+		os.Exit(1)
+	}
+
+	if *listPostsFlag {
+		listPosts(os.Stdout, config)
+		return
+	}
+
+	if *renderFlag {
+		date := time.Now()
+		if *renderDate != "" {
+			if date, err = time.Parse("2006-01-02", *renderDate); err != nil {
+				log.Printf("Invalid -render-date: %v", err)
+				os.Exit(1)
+			}
+		}
+		if failures := renderPosts(os.Stdout, config, date, *renderRows); failures > 0 {
+			fmt.Printf("%d template(s) failed to render\n", failures)
+			os.Exit(1)
+		}
+		return
+	}
+
+	configureLogger(config)
+	if config.LogLevel == logLevelWarn {
+		quiet = true
+	}
+	if config.MaxSMTPConnections > 0 {
+		smtpConnections = make(chan struct{}, config.MaxSMTPConnections)
+	}
+	if config.LogLevel == logLevelDebug && config.DebugDumpMessages {
+		dumpMessages = true
+		dumpRedact = config.DebugDumpRedact == nil || *config.DebugDumpRedact
+		log.Println("Warning: debug_dump_messages is enabled, full email messages are written to the log")
+	}
+
+	issues := validateConfig(config)
+	if *validate {
+		if len(issues) > 0 {
+			fmt.Printf("Found %d issue(s) in %s:\n", len(issues), *configPath)
+			for _, issue := range issues {
+				fmt.Printf("  - %s\n", issue)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid\n", *configPath)
+		return
+	}
+	if len(issues) > 0 {
+		for _, issue := range issues {
+			log.Printf("Invalid configuration: %s", issue)
+		}
 		return
 	}
 
-	log.Println("Configuration loaded successfully")
+	// Vault is only contacted when the posts are going to run, so that
+	// -validate, -list-posts and -render work without connecting to anything
+	if err := resolveVaultSecrets(context.Background(), config); err != nil {
+		log.Printf("Failed to resolve Vault secrets: %v", err)
+		os.Exit(1)
+	}
+
+	logInfoln("Configuration loaded successfully")
+
+	if config.StartupSelfTest {
+		if err := runSelfTest(*config); err != nil && config.SelfTestStrict {
+			log.Printf("Aborting startup: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	logInfoln("Starting...")
 
-	c := cron.New()
+	c := cron.New(cron.WithParser(config.cronParser()))
 	_, err = c.AddFunc(config.Time, func() {
-		task(*config)
+		if _, err := runTask(*config); err != nil {
+			log.Printf("Task failed: %v", err)
+		}
 	})
 
 	if err != nil {
@@ -492,7 +4179,9 @@ func main() {
 		return
 	}
 
-	c.Start()
+	logInfof("Scheduled %d post(s) with cron expression %q", len(config.Post), config.Time)
 
-	select {}
+	if err := runService(c); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	from := time.Date(2024, 1, 2, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		format  string
+		spec    string
+		next    time.Time
+		wantErr string
+	}{
+		{"standard", "", "0 9 * * *", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), ""},
+		{"explicit standard", cronFormatStandard, "*/15 8 * * *", time.Date(2024, 1, 2, 8, 15, 0, 0, time.UTC), ""},
+		{"descriptor", "", "@daily", time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), ""},
+		{"with seconds", cronFormatWithSeconds, "30 0 9 * * *", time.Date(2024, 1, 2, 9, 0, 30, 0, time.UTC), ""},
+		{"with seconds descriptor", cronFormatWithSeconds, "@hourly", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), ""},
+		{"six fields in standard format", "", "30 0 9 * * *", time.Time{}, "set cron_format to with_seconds"},
+		{"five fields with seconds", cronFormatWithSeconds, "0 9 * * *", time.Time{}, "this looks like a standard 5-field expression"},
+		{"invalid field", "", "0 25 * * *", time.Time{}, "end of range"},
+		{"empty", "", "", time.Time{}, "empty spec"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := Config{Time: tt.spec, CronFormat: tt.format}.parseSchedule()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSchedule(%q) error = %v, want it to contain %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSchedule(%q): %v", tt.spec, err)
+			}
+			if got := schedule.Next(from); !got.Equal(tt.next) {
+				t.Errorf("parseSchedule(%q).Next(%s) = %s, want %s", tt.spec, from, got, tt.next)
+			}
+		})
+	}
+}
+
+func TestApplyScheduleOverride(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{"unset", "", "0 9 * * *"},
+		{"blank", "  ", "0 9 * * *"},
+		{"override", " 0 18 * * 1-5 ", "0 18 * * 1-5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(scheduleEnv, tt.env)
+			config := Config{Time: "0 9 * * *"}
+			applyScheduleOverride(&config)
+			if config.Time != tt.want {
+				t.Errorf("Time = %q, want %q", config.Time, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaskValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		mode  string
+		want  string
+	}{
+		{"full", "secret", maskFull, "******"},
+		{"full multibyte", "张三丰", maskFull, "***"},
+		{"full empty", "", maskFull, ""},
+		{"unknown mode masks fully", "abc", "", "***"},
+		{"last4", "4111111111111111", maskLast4, "************1111"},
+		{"last4 multibyte", "一二三四五六", maskLast4, "**三四五六"},
+		{"last4 short", "1234", maskLast4, "****"},
+		{"last4 shorter", "12", maskLast4, "**"},
+		{"hash", "abc", maskHash, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{"hash empty", "", maskHash, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(maskValue([]byte(tt.value), tt.mode)); got != tt.want {
+				t.Errorf("maskValue(%q, %q) = %q, want %q", tt.value, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyMasks(t *testing.T) {
+	result := &ResultSet{
+		Columns: []string{"ID", "Card_No", "EMAIL"},
+		Rows: [][][]byte{
+			{[]byte("1"), []byte("4111111111111111"), []byte("a@example.com")},
+			{[]byte("2"), nil, []byte("b@example.com")},
+		},
+	}
+	applyMasks(result, map[string]string{"card_no": maskLast4, "email": maskFull, "missing": maskHash})
+
+	want := [][]string{
+		{"1", "************1111", "*************"},
+		{"2", "<nil>", "*************"},
+	}
+	for i, row := range result.Rows {
+		for j, value := range row {
+			got := string(value)
+			if value == nil {
+				got = "<nil>"
+			}
+			if got != want[i][j] {
+				t.Errorf("row %d column %s = %q, want %q", i+1, result.Columns[j], got, want[i][j])
+			}
+		}
+	}
+}
+
+func TestResolveFileName(t *testing.T) {
+	today := time.Now().Format(fileDateLayout)
+	result := &ResultSet{
+		Columns: []string{"REGION", "DATE", "Code"},
+		Rows:    [][][]byte{{[]byte("North/East"), []byte("1999-12-31"), []byte("A1")}},
+	}
+	tests := []struct {
+		name     string
+		fileName string
+		result   *ResultSet
+		want     string
+		wantErr  bool
+	}{
+		{"plain", "report.xlsx", result, "report.xlsx", false},
+		{"date", "report_{{.date}}.xlsx", result, "report_" + today + ".xlsx", false},
+		{"column", "report_{{.code}}.xlsx", result, "report_A1.xlsx", false},
+		{"date column does not replace date", "{{.region}}_{{.date}}.xlsx", result, "North_East_" + today + ".xlsx", false},
+		{"no rows", "report_{{.date}}.xlsx", &ResultSet{Columns: result.Columns}, "report_" + today + ".xlsx", false},
+		{"no rows, column template", "{{.region}}.xlsx", &ResultSet{Columns: result.Columns}, ".xlsx", false},
+		{"no rows, column and date", "report_{{.code}}_{{.date}}.xlsx", &ResultSet{Columns: result.Columns}, "report__" + today + ".xlsx", false},
+		{"missing column", "report_{{.missing}}.xlsx", result, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveFileName(tt.fileName, tt.result)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveFileName(%q) error = %v, want error %v", tt.fileName, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveFileName(%q) = %q, want %q", tt.fileName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostKey(t *testing.T) {
+	config := Config{Post: []PostConfig{
+		{Subject: "Daily"},
+		{Subject: "Weekly"},
+		{Subject: "Daily", ID: "daily-finance"},
+		{Subject: "Daily"},
+		{Subject: "Daily"},
+	}}
+	want := []string{"Daily", "Weekly", "daily-finance", "Daily #2", "Daily #3"}
+	for i := range config.Post {
+		if got := config.postKey(i); got != want[i] {
+			t.Errorf("postKey(%d) = %q, want %q", i, got, want[i])
+		}
+	}
+
+	// Inserting a post with another subject keeps the keys of the others
+	config.Post = append([]PostConfig{{Subject: "Monthly"}}, config.Post...)
+	for i := range want {
+		if got := config.postKey(i + 1); got != want[i] {
+			t.Errorf("after insert, postKey(%d) = %q, want %q", i+1, got, want[i])
+		}
+	}
+}
+
+// smtpSink starts an SMTP server that accepts every message and returns its
+// host and port and a function counting the messages received so far.
+func smtpSink(t *testing.T) (string, int, func() int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mu sync.Mutex
+	messages := 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				text := textproto.NewConn(conn)
+				text.PrintfLine("220 localhost")
+				for {
+					line, err := text.ReadLine()
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+					case "EHLO":
+						text.PrintfLine("250 localhost")
+					case "DATA":
+						text.PrintfLine("354 go ahead")
+						if _, err := text.ReadDotBytes(); err != nil {
+							return
+						}
+						mu.Lock()
+						messages++
+						mu.Unlock()
+						text.PrintfLine("250 ok")
+					case "QUIT":
+						text.PrintfLine("221 bye")
+						return
+					default:
+						text.PrintfLine("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+
+	address := listener.Addr().(*net.TCPAddr)
+	return address.IP.String(), address.Port, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return messages
+	}
+}
+
+func TestResumeSameSubjectPosts(t *testing.T) {
+	host, port, received := smtpSink(t)
+	config := Config{
+		Email:         EmailConfig{Host: host, Port: port, Plain: true},
+		StateFile:     filepath.Join(t.TempDir(), "state.json"),
+		LazyDBConnect: true,
+		Post: []PostConfig{
+			{From: "reports@example.com", To: []string{"a@example.com"}, Subject: "Daily", Body: "sales"},
+			{From: "reports@example.com", To: []string{"a@example.com"}, Subject: "Daily", Body: "stock"},
+		},
+	}
+
+	// The interrupted run delivered the first post only
+	state := newState()
+	if err := state.markDelivered(config.StateFile, config.postKey(0), "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	report := &DeliveryReport{}
+	if err := task(context.Background(), config, true, report); err != nil {
+		t.Fatalf("task: %v", err)
+	}
+	if got := received(); got != 1 {
+		t.Errorf("resumed run sent %d messages, want 1", got)
+	}
+	statuses := make([]string, 0)
+	for _, record := range report.records() {
+		statuses = append(statuses, record.Status)
+	}
+	sort.Strings(statuses)
+	if want := []string{deliverySent, deliverySkipped}; strings.Join(statuses, ",") != strings.Join(want, ",") {
+		t.Errorf("delivery statuses = %v, want %v", statuses, want)
+	}
+}
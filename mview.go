@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// splitObjectName splits a table name into its schema and object names as
+// stored in the data dictionary. Unquoted names are upper-cased like DM does.
+//
+// @param name: table name, optionally prefixed by its schema
+// @return string: schema name, empty for the current schema
+// @return string: object name
+func splitObjectName(name string) (string, string) {
+	normalize := func(part string) string {
+		part = strings.TrimSpace(part)
+		if len(part) >= 2 && strings.HasPrefix(part, `"`) && strings.HasSuffix(part, `"`) {
+			return part[1 : len(part)-1]
+		}
+		return strings.ToUpper(part)
+	}
+
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		return normalize(name[:i]), normalize(name[i+1:])
+	}
+	return "", normalize(name)
+}
+
+// refreshMaterializedView refreshes the materialized view exported by an
+// attachment, after checking that the table is one.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return error: error if any
+func refreshMaterializedView(ctx context.Context, db *sql.DB, attachmentConfig TableAttachmentConfig) error {
+	ctx, cancel := attachmentConfig.queryContext(ctx)
+	defer cancel()
+
+	schema, name := splitObjectName(attachmentConfig.Table)
+	var count int
+	var err error
+	if schema == "" {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM USER_MVIEWS WHERE MVIEW_NAME = ?", name).Scan(&count)
+	} else {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM ALL_MVIEWS WHERE OWNER = ? AND MVIEW_NAME = ?", schema, name).Scan(&count)
+	}
+	if err != nil {
+		log.Printf("Failed to look up materialized view %s: %v", attachmentConfig.Table, err)
+		return err
+	}
+	if count == 0 {
+		err := fmt.Errorf("%s is not a materialized view", attachmentConfig.Table)
+		log.Printf("Failed to refresh materialized view: %v", err)
+		return err
+	}
+
+	logInfof("Refreshing materialized view %s", attachmentConfig.Table)
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("REFRESH MATERIALIZED VIEW %s", attachmentConfig.Table)); err != nil {
+		log.Printf("Failed to refresh materialized view %s: %v", attachmentConfig.Table, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// exportPagedTable exports a table read in pages of page_size rows, each with
+// its own query, so no single cursor stays open for the whole table. Each page
+// is written to the files before the next one is read, so memory use does not
+// grow with the table. The attachments keep the columns and the first row of
+// the table, for file name templates.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return []Attachment: exported files, one per format
+// @return error: error if any
+func exportPagedTable(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) ([]Attachment, error) {
+	formats := attachmentConfig.formats()
+	source := "table " + attachmentConfig.Table
+
+	var first *ResultSet
+	var excelWriter *excelStreamWriter
+	var csvWriter *csvTableWriter
+	defer func() {
+		if excelWriter != nil {
+			excelWriter.file.Close()
+		}
+	}()
+
+	offset := 0
+	for page := 1; ; page++ {
+		size := attachmentConfig.PageSize
+		if attachmentConfig.Limit > 0 {
+			size = min(size, attachmentConfig.Limit-offset)
+		}
+
+		var rows *ResultSet
+		err := retryExport(ctx, attachmentConfig, func() error {
+			var err error
+			rows, err = runQuery(ctx, db, tablePageQuery(attachmentConfig, offset, size), fmt.Sprintf("%s (page %d)", source, page), attachmentConfig)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if first == nil {
+			first = &ResultSet{
+				Columns: rows.Columns,
+				Types:   rows.Types,
+				Rows:    append([][][]byte(nil), rows.Rows[:min(1, len(rows.Rows))]...),
+			}
+			for _, format := range formats {
+				switch format {
+				case formatXLSX:
+					excelWriter, err = newExcelStreamWriter(first, attachmentConfig)
+				case formatCSV:
+					csvWriter, err = newCSVTableWriter(first.Columns, attachmentConfig)
+				default:
+					err = fmt.Errorf("format %s is not supported with page_size", format)
+				}
+				if err != nil {
+					log.Printf("Failed to write table %s as %s: %v", attachmentConfig.Table, format, err)
+					return nil, err
+				}
+			}
+		}
+
+		if excelWriter != nil {
+			if err := excelWriter.writeRows(rows.Rows); err != nil {
+				log.Printf("Failed to write page %d of table %s as %s: %v", page, attachmentConfig.Table, formatXLSX, err)
+				return nil, err
+			}
+		}
+		if csvWriter != nil {
+			if err := csvWriter.writeRows(rows.Rows); err != nil {
+				return nil, err
+			}
+		}
+		offset += len(rows.Rows)
+		logInfof("Wrote page %d of %s: %d rows, %d in total", page, source, len(rows.Rows), offset)
+
+		if len(rows.Rows) < size || (attachmentConfig.Limit > 0 && offset >= attachmentConfig.Limit) {
+			break
+		}
+	}
+
+	var err error
+	attachmentConfig.Excel, err = resolveFileName(attachmentConfig.Excel, first)
+	if err != nil {
+		log.Printf("Failed to resolve file name of table %s: %v", attachmentConfig.Table, err)
+		return nil, err
+	}
+
+	attachments := make([]Attachment, 0, len(formats))
+	for _, format := range formats {
+		var buffer *bytes.Buffer
+		var mimeType string
+		switch format {
+		case formatXLSX:
+			buffer, err = excelWriter.finish(attachmentConfig)
+			mimeType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case formatCSV:
+			buffer, err = csvWriter.finish()
+			mimeType = "text/csv; charset=utf-8"
+		}
+		if err != nil {
+			log.Printf("Failed to write table %s as %s: %v", attachmentConfig.Table, format, err)
+			return nil, err
+		}
+
+		attachments = append(attachments, Attachment{
+			fileName: attachmentConfig.fileName(format),
+			mimeType: mimeType,
+			file:     buffer,
+			rows:     offset,
+			result:   first,
+		})
+	}
+
+	logInfof("Successfully exported table %s: %d rows in pages of %d", attachmentConfig.Table, offset, attachmentConfig.PageSize)
+	return attachments, nil
+}
+
+// excelStreamWriter writes the rows of a table to a workbook through an
+// excelize stream writer, which keeps large sheets out of memory.
+type excelStreamWriter struct {
+	file           *excelize.File
+	stream         *excelize.StreamWriter
+	table          *ResultSet
+	columns        *ResultSet
+	rowNumbers     bool
+	numericColumns map[int]bool
+	dateStyles     map[int]int
+	nextRow        int
+	written        int
+}
+
+// newExcelStreamWriter starts a workbook with the title and header rows.
+//
+// @param result: columns of the table
+// @param attachmentConfig: table attachment configuration
+// @return *excelStreamWriter: Excel writer
+// @return error: error if any
+func newExcelStreamWriter(result *ResultSet, attachmentConfig TableAttachmentConfig) (*excelStreamWriter, error) {
+	table := &ResultSet{Columns: result.Columns, Types: result.Types}
+	columns := table
+	if attachmentConfig.AddRowNumbers {
+		columns = withRowNumbers(table)
+	}
+
+	file := excelize.NewFile()
+	stream, err := file.NewStreamWriter("Sheet1")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w := &excelStreamWriter{
+		file:           file,
+		stream:         stream,
+		table:          table,
+		columns:        columns,
+		rowNumbers:     attachmentConfig.AddRowNumbers,
+		numericColumns: make(map[int]bool),
+		dateStyles:     make(map[int]int),
+	}
+
+	if attachmentConfig.Title != "" {
+		titleStyle, err := file.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true, Size: 14}})
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if err := stream.SetRow("A1", []interface{}{excelize.Cell{StyleID: titleStyle, Value: attachmentConfig.Title}}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	headerStyle := 0
+	if styles := attachmentConfig.Styles; styles != nil && styles.Header != nil {
+		if headerStyle, err = file.NewStyle(styles.Header); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	header := make([]interface{}, len(columns.Columns))
+	for i, colName := range columns.Columns {
+		header[i] = excelize.Cell{StyleID: headerStyle, Value: colName}
+	}
+	headerRow := attachmentConfig.headerRow()
+	cell, _ := excelize.CoordinatesToCellName(1, headerRow)
+	if err := stream.SetRow(cell, header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.nextRow = headerRow + 1
+
+	if attachmentConfig.AddRowNumbers {
+		w.numericColumns[0] = true
+	}
+	dateColumns, err := columnKinds(columns, attachmentConfig, w.numericColumns)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	for colIndex := range dateColumns {
+		numFmt := dateNumFmt(columns.Types[colIndex], attachmentConfig.DateFormat)
+		if w.dateStyles[colIndex], err = file.NewStyle(&excelize.Style{CustomNumFmt: &numFmt}); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// writeRows appends rows to the sheet.
+//
+// @param rows: raw column values; a nil value represents NULL
+// @return error: error if any
+func (w *excelStreamWriter) writeRows(rows [][][]byte) error {
+	values := make([]interface{}, len(w.columns.Columns))
+	for _, row := range rows {
+		w.written++
+		offset := 0
+		if w.rowNumbers {
+			values[0] = w.written
+			offset = 1
+		}
+		for i, value := range row {
+			colIndex := i + offset
+			_, date := w.dateStyles[colIndex]
+			content := cellValue(value, w.numericColumns[colIndex], date)
+			if _, ok := content.(time.Time); ok {
+				values[colIndex] = excelize.Cell{StyleID: w.dateStyles[colIndex], Value: content}
+			} else {
+				values[colIndex] = content
+			}
+		}
+
+		cell, _ := excelize.CoordinatesToCellName(1, w.nextRow)
+		if err := w.stream.SetRow(cell, values); err != nil {
+			return err
+		}
+		w.nextRow++
+	}
+	return nil
+}
+
+// finish completes the sheet, adds the column descriptions sheet when
+// configured and writes the workbook.
+//
+// @param attachmentConfig: table attachment configuration
+// @return *bytes.Buffer: Excel file buffer
+// @return error: error if any
+func (w *excelStreamWriter) finish(attachmentConfig TableAttachmentConfig) (*bytes.Buffer, error) {
+	if err := w.stream.Flush(); err != nil {
+		return nil, err
+	}
+
+	if len(attachmentConfig.Descriptions) > 0 {
+		if err := writeColumnsSheet(w.file, w.table, attachmentConfig.Descriptions); err != nil {
+			log.Printf("Failed to write column descriptions: %v", err)
+			return nil, err
+		}
+	}
+	w.file.SetActiveSheet(0)
+
+	buffer := new(bytes.Buffer)
+	if err := w.file.Write(buffer); err != nil {
+		log.Printf("Failed to write Excel file to buffer: %v", err)
+		return nil, err
+	}
+	return buffer, nil
+}
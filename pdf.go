@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Layout of the generated PDF: A4 pages of 9 pt text, with lines as wide as
+// pdfLineChars Courier characters.
+const (
+	pdfPageWidth    = 595
+	pdfPageHeight   = 842
+	pdfMargin       = 40
+	pdfFontSize     = 9
+	pdfLineHeight   = 12
+	pdfLineChars    = 95
+	pdfLinesPerPage = (pdfPageHeight - 2*pdfMargin) / pdfLineHeight
+)
+
+// Glyph widths in thousandths of the font size: Courier characters and the
+// full-width characters of the CJK font.
+const (
+	pdfNarrowWidth = 600
+	pdfWideWidth   = 1000
+)
+
+// pdfFonts are the font objects of the generated PDF, numbered from 3: the
+// standard Courier font for Latin-1 text (/F1), and the STSong-Light CJK font
+// (/F2), which is referenced rather than embedded and addressed in UTF-16, so
+// that Chinese text is shown by readers that provide the Adobe Asian fonts or a
+// substitute for them.
+var pdfFonts = []string{
+	"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+	"<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [5 0 R] >>",
+	"<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light /CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> /FontDescriptor 6 0 R /DW 1000 >>",
+	"<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880] /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>",
+}
+
+// writeTextPDF renders lines of plain text into a PDF document. Latin-1 text is
+// set in Courier and other characters in the CJK font; control characters and
+// characters beyond the Basic Multilingual Plane are replaced by "?". Long
+// lines are wrapped.
+//
+// @param lines: text lines
+// @return []byte: PDF document
+func writeTextPDF(lines []string) []byte {
+	wrapped := make([]string, 0, len(lines))
+	for _, line := range lines {
+		wrapped = append(wrapped, wrapPDFLine(line)...)
+	}
+
+	var pages [][]string
+	for len(wrapped) > pdfLinesPerPage {
+		pages = append(pages, wrapped[:pdfLinesPerPage])
+		wrapped = wrapped[pdfLinesPerPage:]
+	}
+	pages = append(pages, wrapped)
+
+	// Objects 1 and 2 are the catalog and page tree, followed by the fonts and
+	// a page and a content stream object per page
+	objects := append([]string{"", ""}, pdfFonts...)
+	kids := make([]string, 0, len(pages))
+	for _, page := range pages {
+		pageID, contentID := len(objects)+1, len(objects)+2
+		kids = append(kids, fmt.Sprintf("%d 0 R", pageID))
+
+		var content strings.Builder
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", pdfFontSize, pdfLineHeight, pdfMargin, pdfPageHeight-pdfMargin)
+		font := "/F1"
+		for _, line := range page {
+			content.WriteString("T*")
+			for _, run := range pdfTextRuns(line) {
+				if run.font != font {
+					font = run.font
+					fmt.Fprintf(&content, " %s %d Tf", font, pdfFontSize)
+				}
+				fmt.Fprintf(&content, " %s Tj", run.text)
+			}
+			content.WriteString("\n")
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, contentID),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()))
+	}
+	objects[0] = "<< /Type /Catalog /Pages 2 0 R >>"
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages))
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buffer.Len()
+		fmt.Fprintf(buffer, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := buffer.Len()
+	fmt.Fprintf(buffer, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buffer, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buffer, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buffer.Bytes()
+}
+
+// pdfWide reports whether a character is set in the CJK font.
+//
+// @param r: character
+// @return bool: true for characters beyond Latin-1 within the Basic Multilingual Plane
+func pdfWide(r rune) bool {
+	return r > 0xff && r <= 0xffff
+}
+
+// wrapPDFLine splits a line into lines that fit the width of the page.
+//
+// @param line: text line
+// @return []string: wrapped lines, at least one
+func wrapPDFLine(line string) []string {
+	wrapped := make([]string, 0, 1)
+	start, width := 0, 0
+	for i, r := range line {
+		charWidth := pdfNarrowWidth
+		if pdfWide(r) {
+			charWidth = pdfWideWidth
+		}
+		if width+charWidth > pdfLineChars*pdfNarrowWidth {
+			wrapped = append(wrapped, line[start:i])
+			start, width = i, 0
+		}
+		width += charWidth
+	}
+	return append(wrapped, line[start:])
+}
+
+// pdfTextRun is a part of a line set in one font.
+type pdfTextRun struct {
+	font string
+	text string
+}
+
+// pdfTextRuns splits a line into runs of Latin-1 and CJK text, each encoded as
+// a PDF string for its font: a literal string in Latin-1, or a hexadecimal
+// string in UTF-16.
+//
+// @param line: text line
+// @return []pdfTextRun: runs in line order
+func pdfTextRuns(line string) []pdfTextRun {
+	runs := make([]pdfTextRun, 0, 1)
+	var latin, wide strings.Builder
+	flush := func() {
+		if latin.Len() > 0 {
+			runs = append(runs, pdfTextRun{font: "/F1", text: "(" + pdfEscape(latin.String()) + ")"})
+			latin.Reset()
+		}
+		if wide.Len() > 0 {
+			runs = append(runs, pdfTextRun{font: "/F2", text: "<" + wide.String() + ">"})
+			wide.Reset()
+		}
+	}
+	for _, r := range line {
+		if pdfWide(r) {
+			if latin.Len() > 0 {
+				flush()
+			}
+			fmt.Fprintf(&wide, "%04X", r)
+			continue
+		}
+		if wide.Len() > 0 {
+			flush()
+		}
+		latin.WriteRune(r)
+	}
+	flush()
+	return runs
+}
+
+// pdfEscape escapes a line for a PDF string literal, encoding it in Latin-1.
+//
+// @param line: text line
+// @return string: escaped string contents
+func pdfEscape(line string) string {
+	var escaped strings.Builder
+	for _, r := range line {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteRune(r)
+		case r < 0x20 || r > 0xff:
+			escaped.WriteByte('?')
+		default:
+			escaped.WriteByte(byte(r))
+		}
+	}
+	return escaped.String()
+}
+
+// runReportPDF renders an overview of a run as a PDF: the attachments exported
+// by each post and the final delivery status of each recipient.
+//
+// @param report: report of the run
+// @param attempts: number of attempts made
+// @param taskErr: error of the last attempt, nil if the run succeeded
+// @return []byte: PDF document
+func runReportPDF(report *DeliveryReport, attempts int, taskErr error) []byte {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	status := "completed"
+	if taskErr != nil {
+		status = "failed"
+	}
+
+	lines := []string{
+		"DMDataPushMailer run report",
+		"",
+		fmt.Sprintf("Host:      %s", hostname),
+		fmt.Sprintf("Generated: %s", time.Now().Format(time.RFC3339)),
+		fmt.Sprintf("Result:    %s after %d attempt(s)", status, attempts),
+	}
+	if taskErr != nil {
+		lines = append(lines, fmt.Sprintf("Error:     %v", taskErr))
+	}
+
+	lines = append(lines, "", "Exports", "")
+	lines = append(lines, fmt.Sprintf("%-30s %-28s %8s %10s %10s", "Post", "File", "Rows", "Bytes", "Duration"))
+	for _, export := range report.exportRecords() {
+		lines = append(lines, fmt.Sprintf("%-30s %-28s %8d %10d %10s",
+			export.Post, export.File, export.Rows, export.Bytes, export.Duration.Round(time.Millisecond)))
+	}
+
+	lines = append(lines, "", "Deliveries", "")
+	lines = append(lines, fmt.Sprintf("%-30s %-30s %-9s %-19s", "Post", "Recipient", "Status", "Time"))
+	for _, record := range report.finalRecords() {
+		lines = append(lines, fmt.Sprintf("%-30s %-30s %-9s %-19s",
+			record.Post, record.Recipient, record.Status, record.Time.Format("2006-01-02 15:04:05")))
+		if record.Error != "" {
+			lines = append(lines, "    "+record.Error)
+		}
+	}
+	return writeTextPDF(lines)
+}
+
+// writeSummaryPDF writes the PDF run report to the configured path, replacing
+// the report of the previous run.
+//
+// @param config: configuration
+// @param pdf: PDF document
+// @return error: error if any
+func writeSummaryPDF(config Config, pdf []byte) error {
+	mode, err := config.fileMode()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(config.SummaryPDF, pdf, mode); err != nil {
+		return err
+	}
+	logInfof("Run report written to %s", config.SummaryPDF)
+	return nil
+}
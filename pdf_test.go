@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPDFEscape(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"plain text", "plain text"},
+		{"f(x) = a\\b", "f\\(x\\) = a\\\\b"},
+		{"tab\there", "tab?here"},
+		{"café", "caf\xe9"},
+		{"报表 ok", "?? ok"},
+	}
+	for _, tt := range tests {
+		if got := pdfEscape(tt.line); got != tt.want {
+			t.Errorf("pdfEscape(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestWriteTextPDF(t *testing.T) {
+	lines := func(n int) []string {
+		result := make([]string, n)
+		for i := range result {
+			result[i] = fmt.Sprintf("line %d", i+1)
+		}
+		return result
+	}
+	tests := []struct {
+		name      string
+		lines     []string
+		pages     int
+		textLines int
+	}{
+		{"empty", nil, 1, 0},
+		{"one line", []string{"Run report"}, 1, 1},
+		{"wrapped line", []string{strings.Repeat("x", pdfLineChars*2+1)}, 1, 3},
+		{"full page", lines(pdfLinesPerPage), 1, pdfLinesPerPage},
+		{"second page", lines(pdfLinesPerPage + 1), 2, pdfLinesPerPage + 1},
+		{"wrapped wide line", []string{strings.Repeat("报", pdfLineChars*pdfNarrowWidth/pdfWideWidth+1)}, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdf := writeTextPDF(tt.lines)
+			if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+				t.Fatalf("missing PDF header or trailer:\n%s", pdf)
+			}
+			if got := bytes.Count(pdf, []byte("/Type /Page ")); got != tt.pages {
+				t.Errorf("%d pages, want %d", got, tt.pages)
+			}
+			if got := bytes.Count(pdf, []byte("T*")); got != tt.textLines {
+				t.Errorf("%d text lines, want %d", got, tt.textLines)
+			}
+			checkPDFXref(t, pdf)
+
+			for _, match := range regexp.MustCompile(`/Length (\d+) >>\nstream\n`).FindAllSubmatchIndex(pdf, -1) {
+				length, _ := strconv.Atoi(string(pdf[match[2]:match[3]]))
+				if !bytes.HasPrefix(pdf[match[1]+length:], []byte("\nendstream")) {
+					t.Errorf("stream at %d does not end after /Length %d", match[1], length)
+				}
+			}
+		})
+	}
+}
+
+func TestPDFTextRuns(t *testing.T) {
+	tests := []struct {
+		line string
+		want []pdfTextRun
+	}{
+		{"", []pdfTextRun{}},
+		{"Run (ok)", []pdfTextRun{{"/F1", `(Run \(ok\))`}}},
+		{"报表", []pdfTextRun{{"/F2", "<62A58868>"}}},
+		{"Post 日报 sent", []pdfTextRun{{"/F1", "(Post )"}, {"/F2", "<65E562A5>"}, {"/F1", "( sent)"}}},
+		{"café €1 😀", []pdfTextRun{{"/F1", "(caf\xe9 )"}, {"/F2", "<20AC>"}, {"/F1", "(1 ?)"}}},
+	}
+	for _, tt := range tests {
+		got := pdfTextRuns(tt.line)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("pdfTextRuns(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+// checkPDFXref checks that startxref points to the cross-reference table and
+// that every entry of the table points to its object.
+func checkPDFXref(t *testing.T, pdf []byte) {
+	t.Helper()
+	match := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if match == nil {
+		t.Fatal("startxref not found")
+	}
+	xref, _ := strconv.Atoi(string(match[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d does not point to the xref table", xref)
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n \n`).FindAllSubmatch(pdf[xref:], -1)
+	if len(entries) == 0 {
+		t.Fatal("xref table has no entries")
+	}
+	for i, entry := range entries {
+		offset, _ := strconv.Atoi(string(entry[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points to %q, want %q", i+1, pdf[offset:min(offset+len(want), len(pdf))], want)
+		}
+	}
+}
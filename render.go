@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// renderPosts prints what each post would send, without connecting to the
+// database or SMTP servers: the subject, the body and the attachment names,
+// with file name templates evaluated against sample data. Each value referenced
+// by a template is set to "sample_<name>".
+//
+// @param out: output writer
+// @param config: configuration
+// @param date: date used for {{.date}}
+// @param rows: number of sample rows; with 0, column values are empty
+// @return int: number of templates that failed to render
+func renderPosts(out io.Writer, config *Config, date time.Time, rows int) int {
+	failures := 0
+	for i, post := range config.Post {
+		fmt.Fprintf(out, "Post #%d\n", i+1)
+		fmt.Fprintf(out, "  Subject: %s\n", config.postSubject(post))
+		fmt.Fprintln(out, "  Body:")
+		for _, line := range strings.Split(post.Body, "\n") {
+			fmt.Fprintf(out, "    %s\n", line)
+		}
+		if post.BodyType == bodyTypeMarkdown {
+			html, err := renderMarkdown(post.Body)
+			if err != nil {
+				fmt.Fprintf(out, "  HTML body: error: %v\n", err)
+				failures++
+			} else {
+				fmt.Fprintln(out, "  HTML body:")
+				for _, line := range strings.Split(strings.TrimRight(html, "\n"), "\n") {
+					fmt.Fprintf(out, "    %s\n", line)
+				}
+			}
+		}
+
+		fmt.Fprintln(out, "  Attachments:")
+		for j, attachment := range post.orderedAttachments() {
+			for _, fileName := range attachment.fileNames() {
+				rendered, err := renderFileName(fileName, date, rows)
+				if err != nil {
+					fmt.Fprintf(out, "    - attachment #%d: %s: error: %v\n", j+1, fileName, err)
+					failures++
+					continue
+				}
+				fmt.Fprintf(out, "    - %s\n", rendered)
+			}
+		}
+		if post.CSVZip != "" {
+			fmt.Fprintf(out, "  Sent as: %s\n", post.CSVZip)
+		}
+		fmt.Fprintln(out)
+	}
+	return failures
+}
+
+// renderFileName evaluates a file name template with sample data.
+//
+// @param fileName: file name template
+// @param date: date used for {{.date}}
+// @param rows: number of sample rows
+// @return string: resolved file name
+// @return error: error if the template is invalid
+func renderFileName(fileName string, date time.Time, rows int) (string, error) {
+	if !strings.Contains(fileName, "{{") {
+		return fileName, nil
+	}
+
+	tmpl, err := template.New("file name").Parse(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	// Without rows, the referenced columns are empty as in an empty export
+	data := map[string]string{"date": date.Format(fileDateLayout)}
+	for _, name := range templateFields(tmpl.Tree.Root) {
+		if _, ok := data[name]; !ok {
+			data[name] = ""
+			if rows > 0 {
+				data[name] = "sample_" + name
+			}
+		}
+	}
+	return expandFileName(fileName, data)
+}
+
+// templateFields returns the names of the fields referenced by a template,
+// such as "region" for {{.region}}.
+//
+// @param node: template parse tree node
+// @return []string: field names
+func templateFields(node parse.Node) []string {
+	var fields []string
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node != nil {
+			for _, child := range node.Nodes {
+				fields = append(fields, templateFields(child)...)
+			}
+		}
+	case *parse.ActionNode:
+		fields = append(fields, templateFields(node.Pipe)...)
+	case *parse.PipeNode:
+		if node != nil {
+			for _, command := range node.Cmds {
+				fields = append(fields, templateFields(command)...)
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			fields = append(fields, templateFields(arg)...)
+		}
+	case *parse.FieldNode:
+		fields = append(fields, node.Ident[0])
+	case *parse.IfNode:
+		fields = append(fields, templateFields(&node.BranchNode)...)
+	case *parse.RangeNode:
+		fields = append(fields, templateFields(&node.BranchNode)...)
+	case *parse.WithNode:
+		fields = append(fields, templateFields(&node.BranchNode)...)
+	case *parse.BranchNode:
+		fields = append(fields, templateFields(node.Pipe)...)
+		fields = append(fields, templateFields(node.List)...)
+		fields = append(fields, templateFields(node.ElseList)...)
+	}
+	return fields
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// errRunAborted is returned for work attempted after a run was forcibly terminated.
+var errRunAborted = errors.New("run exceeded max_run_seconds and was terminated")
+
+// runAbortGrace bounds the wait for a run to return after it was cancelled for
+// exceeding max_run_seconds.
+var runAbortGrace = 30 * time.Second
+
+// limitRun runs a function under the max_run_seconds cap. The function is given
+// the run context, which is cancelled when the cap is exceeded: this cancels
+// its queries, closes its database, SMTP and HTTP connections and stops its
+// retries. limitRun then waits up to runAbortGrace for the function to return,
+// so that a terminated run does not overlap the next one, without hanging on a
+// step that ignores the cancellation.
+//
+// @param config: configuration
+// @param run: function running the task
+// @return error: error of the function, or errRunAborted when it overran
+func limitRun(config Config, run func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if config.MaxRunSeconds <= 0 {
+		return run(ctx)
+	}
+
+	limit := time.Duration(config.MaxRunSeconds) * time.Second
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx)
+	}()
+
+	timer := time.NewTimer(limit)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		log.Printf("Warning: run exceeded max_run_seconds (%s), forcing termination: cancelling queries and closing database and SMTP connections", limit)
+		cancel()
+		grace := time.NewTimer(runAbortGrace)
+		defer grace.Stop()
+		select {
+		case <-done:
+		case <-grace.C:
+			log.Printf("Warning: terminated run did not stop within %s, giving up on it; it may still be running", runAbortGrace)
+		}
+		return errRunAborted
+	}
+}
+
+// sleepContext pauses for the given duration, returning early with the context
+// error when the context is cancelled.
+//
+// @param ctx: run context
+// @param duration: pause duration
+// @return error: context error if the pause was cut short
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
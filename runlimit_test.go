@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimitRun(t *testing.T) {
+	defer func(grace time.Duration) { runAbortGrace = grace }(runAbortGrace)
+	runAbortGrace = 50 * time.Millisecond
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name string
+		max  int
+		run  func(ctx context.Context) error
+		want error
+	}{
+		{"no cap", 0, func(ctx context.Context) error { return errFailed }, errFailed},
+		{"within cap", 60, func(ctx context.Context) error { return nil }, nil},
+		{"cancelled", 1, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, errRunAborted},
+		{"ignores cancellation", 1, func(ctx context.Context) error {
+			time.Sleep(time.Minute)
+			return nil
+		}, errRunAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			if err := limitRun(Config{MaxRunSeconds: tt.max}, tt.run); err != tt.want {
+				t.Errorf("limitRun error = %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("limitRun took %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// schemaEnums lists the allowed values of string fields, keyed by struct name
+// and JSON field name. Fields that are arrays of strings apply it to their items,
+// and maps of strings to their values.
+var schemaEnums = map[string][]string{
+	"Config.attachment_encoding":           {encodingBase64, encodingQuotedPrintable, encoding8Bit},
+	"EmailConfig.tls_mode":                 {tlsModeImplicit, tlsModeStartTLS},
+	"SMTPServerConfig.tls_mode":            {tlsModeImplicit, tlsModeStartTLS},
+	"Config.cron_format":                   {cronFormatStandard, cronFormatWithSeconds},
+	"Config.default_formats":               {formatXLSX, formatCSV, formatSQLite},
+	"Config.log_level":                     {logLevelDebug, logLevelInfo, logLevelWarn},
+	"Config.log_timestamp":                 {"none", "seconds", "microseconds"},
+	"PostConfig.body_type":                 {bodyTypeText, bodyTypeMarkdown},
+	"PostConfig.priority":                  {"high", "normal", "low"},
+	"PostConfig.default_formats":           {formatXLSX, formatCSV, formatSQLite},
+	"TableAttachmentConfig.encoding":       {encodingBase64, encodingQuotedPrintable, encoding8Bit},
+	"TableAttachmentConfig.formats":        {formatXLSX, formatCSV, formatSQLite},
+	"TableAttachmentConfig.binary_columns": {binaryPlaceholder, binaryBase64, binaryOmit},
+	"TableAttachmentConfig.mask":           {maskFull, maskLast4, maskHash},
+	"TableAttachmentConfig.column_types":   {columnTypeText, columnTypeNumber, columnTypeDate},
+	"AggregateConfig.function":             {"sum", "avg", "count", "min", "max"},
+	"PrintConfig.orientation":              {"portrait", "landscape"},
+	"ConditionalFormatConfig.rule":         {ruleNegativeRed, rulePositiveGreen, ruleColorScale, ruleDataBar, ruleCell},
+}
+
+// schemaRequired lists the required JSON fields of each struct.
+var schemaRequired = map[string][]string{
+	"Config":            {"email", "db", "post"},
+	"DBConfig":          {"host", "port", "username"},
+	"PostConfig":        {"from"},
+	"HeartbeatConfig":   {"from", "to"},
+	"AdminEmailConfig":  {"from", "to"},
+	"UploadConfig":      {"url"},
+	"QueryConfig":       {"query"},
+	"AggregateConfig":   {"function", "column"},
+	"ChartConfig":       {"type", "category", "values"},
+	"GoogleSheetConfig": {"credentials_file", "spreadsheet_id", "range"},
+}
+
+// configSchema returns a JSON Schema describing the config file, derived from
+// the Config struct so that it follows new options automatically.
+//
+// @return map[string]interface{}: JSON Schema document
+func configSchema() map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(Config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "DMDataPushMailer config"
+	return schema
+}
+
+// typeSchema returns the JSON Schema of a Go type as encoding/json decodes it.
+//
+// @param t: Go type
+// @return map[string]interface{}: JSON Schema of the type
+func typeSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the JSON Schema of a struct, using the same field names
+// as encoding/json.
+//
+// @param t: struct type
+// @return map[string]interface{}: JSON Schema of the struct
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+
+		property := typeSchema(field.Type)
+		if enum, ok := schemaEnums[t.Name()+"."+name]; ok {
+			if items, ok := property["items"].(map[string]interface{}); ok {
+				items["enum"] = enum
+			} else if values, ok := property["additionalProperties"].(map[string]interface{}); ok {
+				values["enum"] = enum
+			} else {
+				property["enum"] = enum
+			}
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required, ok := schemaRequired[t.Name()]; ok {
+		sorted := append([]string(nil), required...)
+		sort.Strings(sorted)
+		schema["required"] = sorted
+	}
+	return schema
+}
+
+// writeConfigSchema writes the JSON Schema of the config file.
+//
+// @param out: output writer
+// @return error: error if any
+func writeConfigSchema(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(configSchema())
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigSchemaEnums(t *testing.T) {
+	schema := configSchema()
+	// property walks the schema along property names, array items ("[]") and
+	// map values ("{}")
+	property := func(path ...string) map[string]interface{} {
+		node := schema
+		for _, name := range path {
+			switch name {
+			case "[]":
+				node = node["items"].(map[string]interface{})
+			case "{}":
+				node = node["additionalProperties"].(map[string]interface{})
+			default:
+				node = node["properties"].(map[string]interface{})[name].(map[string]interface{})
+			}
+		}
+		return node
+	}
+
+	attachment := []string{"post", "[]", "attachment", "[]"}
+	tests := []struct {
+		name string
+		path []string
+		want []string
+	}{
+		{"string", []string{"email", "tls_mode"}, []string{tlsModeImplicit, tlsModeStartTLS}},
+		{"array items", append(attachment, "formats", "[]"), []string{formatXLSX, formatCSV, formatSQLite}},
+		{"map values", append(attachment, "mask", "{}"), []string{maskFull, maskLast4, maskHash}},
+		{"default formats", []string{"default_formats", "[]"}, []string{formatXLSX, formatCSV, formatSQLite}},
+		{"post default formats", []string{"post", "[]", "default_formats", "[]"}, []string{formatXLSX, formatCSV, formatSQLite}},
+		{"column types", append(attachment, "column_types", "{}"), []string{columnTypeText, columnTypeNumber, columnTypeDate}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := property(tt.path...)["enum"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("enum = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// runSelfTest checks at startup that the configured services can be reached:
+// it connects to every database, connects and authenticates to every SMTP
+// server without sending, and runs the query of each attachment of the enabled
+// posts so that it returns no rows. Each check is logged, followed by a summary.
+//
+// @param config: configuration
+// @return error: error if any check failed
+func runSelfTest(config Config) error {
+	logInfoln("Running startup self-test...")
+	ctx := context.Background()
+	passed, failed := 0, 0
+	check := func(name string, err error) {
+		if err != nil {
+			log.Printf("Self-test failed: %s: %v", name, err)
+			failed++
+			return
+		}
+		logInfof("Self-test passed: %s", name)
+		passed++
+	}
+
+	config.LazyDBConnect = true
+	dbs, err := openDatabases(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
+
+	names := []string{""}
+	for name := range config.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		_, err := dbs.get(ctx, name)
+		check(databaseLabel(name), err)
+	}
+
+	for _, server := range selfTestServers(config) {
+		check("SMTP server "+net.JoinHostPort(server.Host, strconv.Itoa(server.Port)), pingSMTPServer(server))
+	}
+
+	for i, post := range config.Post {
+		if !post.enabled() {
+			continue
+		}
+		for j, attachmentConfig := range post.orderedAttachments() {
+			if attachmentConfig.File != "" {
+				continue
+			}
+			if attachmentConfig.QueryTimeout == 0 {
+				attachmentConfig.QueryTimeout = config.QueryTimeout
+			}
+			name := fmt.Sprintf("post #%d attachment #%d query", i+1, j+1)
+			db, err := dbs.get(ctx, attachmentConfig.Database)
+			if err != nil {
+				check(name, err)
+				continue
+			}
+			check(name, checkAttachmentQueries(ctx, db, attachmentConfig))
+		}
+	}
+
+	if failed > 0 {
+		err := fmt.Errorf("%d of %d check(s) failed", failed, passed+failed)
+		log.Printf("Self-test failed: %v", err)
+		return err
+	}
+	logInfof("Self-test passed: %d check(s)", passed)
+	return nil
+}
+
+// databaseLabel names a database in the self-test log.
+//
+// @param name: database name, empty for the default database
+// @return string: database label
+func databaseLabel(name string) string {
+	if name == "" {
+		return "default database"
+	}
+	return "database " + name
+}
+
+// selfTestServers returns the SMTP servers of the default email configuration
+// and of the email profiles, each listed once.
+//
+// @param config: configuration
+// @return []SMTPServerConfig: SMTP servers
+func selfTestServers(config Config) []SMTPServerConfig {
+	profiles := make([]string, 0, len(config.EmailProfiles))
+	for name := range config.EmailProfiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+
+	servers := config.Email.smtpServers()
+	for _, name := range profiles {
+		servers = append(servers, config.EmailProfiles[name].smtpServers()...)
+	}
+
+	seen := make(map[string]bool, len(servers))
+	unique := make([]SMTPServerConfig, 0, len(servers))
+	for _, server := range servers {
+		key := fmt.Sprintf("%s:%d:%s", server.Host, server.Port, server.Username)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, server)
+		}
+	}
+	return unique
+}
+
+// pingSMTPServer connects and authenticates to an SMTP server, then quits
+// without sending anything.
+//
+// @param server: SMTP server configuration
+// @return error: error if any
+func pingSMTPServer(server SMTPServerConfig) error {
+	conn, client, err := openSMTPClient(context.Background(), server)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+	return client.Quit()
+}
+
+// checkAttachmentQueries runs the queries of an attachment wrapped so that they
+// return no rows, which checks the tables, columns and syntax they use.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return error: error if any query fails
+func checkAttachmentQueries(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) error {
+	if len(attachmentConfig.UnionTables) > 0 {
+		var err error
+		if attachmentConfig.Table, err = unionSource(ctx, db, attachmentConfig); err != nil {
+			return err
+		}
+	}
+
+	var queries []string
+	switch {
+	case attachmentConfig.Template != "":
+		for _, query := range attachmentConfig.Cells {
+			queries = append(queries, query)
+		}
+		sort.Strings(queries)
+	case len(attachmentConfig.Queries) > 0:
+		for _, query := range attachmentConfig.Queries {
+			queries = append(queries, query.Query)
+		}
+	case attachmentConfig.SchemaOnly:
+		queries = []string{tableSchemaQuery(attachmentConfig)}
+	default:
+		queries = []string{tableSelect(attachmentConfig)}
+	}
+
+	for _, query := range queries {
+		if err := checkQuery(ctx, db, query, attachmentConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkQuery runs a query as a subquery that returns no rows.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param query: SQL query
+// @param attachmentConfig: table attachment configuration, for the query timeout
+// @return error: error if any
+func checkQuery(ctx context.Context, db queryer, query string, attachmentConfig TableAttachmentConfig) error {
+	ctx, cancel := attachmentConfig.queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM (%s) SELF_TEST WHERE 1 = 0", query))
+	if err != nil {
+		return fmt.Errorf("query %q: %w", query, err)
+	}
+	rows.Close()
+	return rows.Err()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/robfig/cron/v3"
+)
+
+// serviceName is the name used when running as a Windows service.
+const serviceName = "DMDataPushMailer"
+
+// waitForSignal blocks until the process receives an interrupt or termination
+// signal.
+func waitForSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	sig := <-signals
+	logInfof("Received signal %v", sig)
+}
+
+// stopScheduler stops the scheduler and waits for a running task to finish.
+//
+// @param c: cron scheduler
+func stopScheduler(c *cron.Cron) {
+	logInfoln("Stopping, waiting for running tasks to finish...")
+	<-c.Stop().Done()
+	logInfoln("Stopped")
+}
@@ -0,0 +1,51 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/robfig/cron/v3"
+)
+
+// runService runs the scheduler until the process is asked to stop. When
+// started by systemd with Type=notify, readiness and shutdown are reported
+// through sd_notify.
+//
+// @param c: cron scheduler
+// @return error: error if any
+func runService(c *cron.Cron) error {
+	c.Start()
+	logInfoln("Scheduler started")
+	sdNotify("READY=1")
+
+	waitForSignal()
+
+	sdNotify("STOPPING=1")
+	stopScheduler(c)
+	return nil
+}
+
+// sdNotify sends a state notification to systemd. It does nothing when the
+// process was not started by systemd.
+//
+// @param state: notification state, e.g. READY=1
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to connect to systemd notify socket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+}
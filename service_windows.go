@@ -0,0 +1,71 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+
+	"github.com/robfig/cron/v3"
+	"golang.org/x/sys/windows/svc"
+)
+
+// runService runs the scheduler until the process is asked to stop. When
+// started by the Windows service control manager, it runs as a service and
+// stops on the Stop and Shutdown controls; otherwise it stops on Ctrl+C.
+//
+// @param c: cron scheduler
+// @return error: error if any
+func runService(c *cron.Cron) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("Failed to detect Windows service: %v", err)
+		return err
+	}
+
+	if !isService {
+		c.Start()
+		logInfoln("Scheduler started")
+		waitForSignal()
+		stopScheduler(c)
+		return nil
+	}
+
+	if err := svc.Run(serviceName, &serviceHandler{cron: c}); err != nil {
+		log.Printf("Failed to run Windows service: %v", err)
+		return err
+	}
+	return nil
+}
+
+// serviceHandler handles requests from the Windows service control manager.
+type serviceHandler struct {
+	cron *cron.Cron
+}
+
+// Execute starts the scheduler and serves control requests until the service
+// is stopped.
+//
+// @param args: service arguments
+// @param requests: control requests
+// @param status: status updates
+// @return bool: true if the exit code is service specific
+// @return uint32: exit code
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	h.cron.Start()
+	logInfoln("Scheduler started")
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for request := range requests {
+		switch request.Cmd {
+		case svc.Interrogate:
+			status <- request.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			logInfof("Received service control %d", request.Cmd)
+			status <- svc.Status{State: svc.StopPending}
+			stopScheduler(h.cron)
+			return false, 0
+		}
+	}
+	return false, 0
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// sheetsTimeout bounds a single request to the Google APIs.
+const sheetsTimeout = time.Minute
+
+// sheetsAPI is the base URL of the Google Sheets API.
+const sheetsAPI = "https://sheets.googleapis.com/v4/spreadsheets/"
+
+// sheetsScope is the OAuth scope granting read and write access to spreadsheets.
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+// GoogleSheetConfig represents the Google Sheet range a table is written to,
+// using the key of a service account that the spreadsheet is shared with. With
+// SinkOnly set, the table is only written to the sheet and not attached.
+type GoogleSheetConfig struct {
+	CredentialsFile string `json:"credentials_file"`
+	SpreadsheetID   string `json:"spreadsheet_id"`
+	Range           string `json:"range"`
+	SinkOnly        bool   `json:"sink_only"`
+}
+
+// serviceAccountKey represents the fields used from a service account key file.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// googleAccessToken exchanges a JWT signed with the service account key for an
+// OAuth access token.
+//
+// @param ctx: run context; cancelling it aborts the request
+// @param credentialsFile: path of the service account key file
+// @return string: access token
+// @return error: error if any
+func googleAccessToken(ctx context.Context, credentialsFile string) (string, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return "", err
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", fmt.Errorf("invalid service account key: %w", err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", errors.New("invalid service account key: no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("invalid service account key: %w", err)
+		}
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("invalid service account key: not an RSA key")
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: sheetsTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", fmt.Errorf("token request failed with status %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+// sheetsRequest sends a request to the Google Sheets API.
+//
+// @param ctx: run context; cancelling it aborts the request
+// @param method: HTTP method
+// @param target: request URL
+// @param token: access token
+// @param payload: JSON request body
+// @return error: error if any
+func sheetsRequest(ctx context.Context, method string, target string, token string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	request.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: sheetsTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("request failed with status %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// writeGoogleSheet clears the configured range of a Google Sheet and fills it
+// with the column names and rows of the result, starting at its first cell.
+// NULL values are written as "NULL", as in the Excel export.
+//
+// @param ctx: run context
+// @param sheet: Google Sheet configuration
+// @param result: rows to write
+// @return error: error if any
+func writeGoogleSheet(ctx context.Context, sheet *GoogleSheetConfig, result *ResultSet) error {
+	logInfof("Writing %d rows to Google Sheet %s range %s", len(result.Rows), sheet.SpreadsheetID, sheet.Range)
+
+	token, err := googleAccessToken(ctx, sheet.CredentialsFile)
+	if err != nil {
+		log.Printf("Failed to authenticate with Google: %v", err)
+		return err
+	}
+
+	values := make([][]string, 0, len(result.Rows)+1)
+	values = append(values, result.Columns)
+	for _, row := range result.Rows {
+		cells := make([]string, len(row))
+		for i, value := range row {
+			if value == nil {
+				cells[i] = "NULL"
+			} else {
+				cells[i] = string(value)
+			}
+		}
+		values = append(values, cells)
+	}
+
+	base := sheetsAPI + url.PathEscape(sheet.SpreadsheetID) + "/values/"
+	if err := sheetsRequest(ctx, http.MethodPost, base+url.PathEscape(sheet.Range)+":clear", token, struct{}{}); err != nil {
+		log.Printf("Failed to clear Google Sheet range %s: %v", sheet.Range, err)
+		return err
+	}
+
+	// Write from the first cell of the range so that the data may outgrow it
+	start, _, _ := strings.Cut(sheet.Range, ":")
+	if err := sheetsRequest(ctx, http.MethodPut, base+url.PathEscape(start)+"?valueInputOption=RAW", token, map[string]interface{}{
+		"range":          start,
+		"majorDimension": "ROWS",
+		"values":         values,
+	}); err != nil {
+		log.Printf("Failed to write Google Sheet range %s: %v", start, err)
+		return err
+	}
+	return nil
+}
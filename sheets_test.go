@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeServiceAccountKey writes a service account key file holding a PEM key
+// and returns its path.
+func writeServiceAccountKey(t *testing.T, pemType string, der []byte, tokenURI string) string {
+	t.Helper()
+	data, err := json.Marshal(serviceAccountKey{
+		ClientEmail: "mailer@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der})),
+		TokenURI:    tokenURI,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "sa.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// tokenServer returns a token endpoint that checks the signed JWT assertion
+// against the public key and answers with an access token.
+func tokenServer(t *testing.T, publicKey *rsa.PublicKey) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm: %v", err)
+		}
+		if got := r.PostForm.Get("grant_type"); got != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("grant_type = %q", got)
+		}
+
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, "malformed assertion", http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+
+		var claims struct {
+			Iss   string `json:"iss"`
+			Scope string `json:"scope"`
+			Aud   string `json:"aud"`
+			Iat   int64  `json:"iat"`
+			Exp   int64  `json:"exp"`
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Errorf("claims: %v", err)
+		}
+		if claims.Iss != "mailer@project.iam.gserviceaccount.com" || claims.Scope != sheetsScope || claims.Aud != "http://"+r.Host+"/token" || claims.Exp-claims.Iat != 3600 {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token":"token-123","token_type":"Bearer","expires_in":3600}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestGoogleAccessToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := tokenServer(t, &rsaKey.PublicKey)
+	tests := []struct {
+		name    string
+		pemType string
+		der     []byte
+		want    string
+		wantErr string
+	}{
+		{"pkcs8", "PRIVATE KEY", pkcs8, "token-123", ""},
+		{"pkcs1", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), "token-123", ""},
+		{"other key", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(otherKey), "", "401 Unauthorized: bad signature"},
+		{"not rsa", "PRIVATE KEY", ecPKCS8, "", "not an RSA key"},
+		{"not a key", "PRIVATE KEY", []byte("garbage"), "", "invalid service account key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeServiceAccountKey(t, tt.pemType, tt.der, server.URL+"/token")
+			token, err := googleAccessToken(context.Background(), path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("googleAccessToken error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("googleAccessToken: %v", err)
+			}
+			if token != tt.want {
+				t.Errorf("token = %q, want %q", token, tt.want)
+			}
+		})
+	}
+
+	t.Run("no pem", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sa.json")
+		os.WriteFile(path, []byte(`{"client_email":"a","private_key":"none"}`), 0o600)
+		if _, err := googleAccessToken(context.Background(), path); err == nil || !strings.Contains(err.Error(), "no PEM private key") {
+			t.Errorf("googleAccessToken error = %v, want no PEM private key", err)
+		}
+	})
+}
+
+func TestSheetsRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr string
+	}{
+		{"ok", http.StatusOK, ""},
+		{"no content", http.StatusNoContent, ""},
+		{"forbidden", http.StatusForbidden, "request failed with status 403 Forbidden: no access"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer token-123" {
+					t.Errorf("Authorization = %q", got)
+				}
+				if got := r.Header.Get("Content-Type"); got != "application/json" {
+					t.Errorf("Content-Type = %q", got)
+				}
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != `{"values":[["ID"],["NULL"]]}` {
+					t.Errorf("body = %s", body)
+				}
+				w.WriteHeader(tt.status)
+				if tt.status == http.StatusForbidden {
+					io.WriteString(w, "no access\n")
+				}
+			}))
+			defer server.Close()
+
+			err := sheetsRequest(context.Background(), http.MethodPut, server.URL, "token-123", map[string]interface{}{"values": [][]string{{"ID"}, {"NULL"}}})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("sheetsRequest: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("sheetsRequest error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
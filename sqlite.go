@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// formatSQLite writes the table into a SQLite database file.
+const formatSQLite = "sqlite"
+
+// sqliteType maps a database column type to the SQLite type of its column, so
+// that numbers stay numbers when queried.
+//
+// @param columnType: column type
+// @return string: SQLite column type
+func sqliteType(columnType *sql.ColumnType) string {
+	switch strings.ToUpper(columnType.DatabaseTypeName()) {
+	case "INT", "INTEGER", "BIGINT", "SMALLINT", "TINYINT", "BYTE", "BIT", "PLS_INTEGER":
+		return "INTEGER"
+	case "DEC", "DECIMAL", "NUMERIC", "NUMBER":
+		return "NUMERIC"
+	case "FLOAT", "DOUBLE", "DOUBLE PRECISION", "REAL":
+		return "REAL"
+	}
+	return "TEXT"
+}
+
+// quoteSQLiteName quotes an identifier for SQLite.
+//
+// @param name: identifier
+// @return string: quoted identifier
+func quoteSQLiteName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// writeSQLite writes the rows into a table of an in-memory SQLite database and
+// returns the serialized database file. The table is named after the exported
+// table without its schema, or "data" for a union of tables.
+//
+// @param result: table rows
+// @param attachmentConfig: table attachment configuration
+// @return *bytes.Buffer: SQLite file buffer
+// @return error: error if any
+func writeSQLite(result *ResultSet, attachmentConfig TableAttachmentConfig) (*bytes.Buffer, error) {
+	tableName := attachmentConfig.Table[strings.LastIndex(attachmentConfig.Table, ".")+1:]
+	if tableName == "" || len(attachmentConfig.UnionTables) > 0 {
+		tableName = "data"
+	}
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		log.Printf("Failed to create SQLite database: %v", err)
+		return nil, err
+	}
+	defer db.Close()
+
+	// Every connection would get its own in-memory database
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Printf("Failed to create SQLite database: %v", err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	definitions := make([]string, len(result.Columns))
+	placeholders := make([]string, len(result.Columns))
+	for i, column := range result.Columns {
+		definitions[i] = quoteSQLiteName(column) + " " + sqliteType(result.Types[i])
+		placeholders[i] = "?"
+	}
+	create := fmt.Sprintf("CREATE TABLE %s (%s)", quoteSQLiteName(tableName), strings.Join(definitions, ", "))
+	if _, err := conn.ExecContext(ctx, create); err != nil {
+		log.Printf("Failed to create SQLite table %s: %v", tableName, err)
+		return nil, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to write SQLite table %s: %v", tableName, err)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s VALUES (%s)", quoteSQLiteName(tableName), strings.Join(placeholders, ", ")))
+	if err != nil {
+		log.Printf("Failed to write SQLite table %s: %v", tableName, err)
+		return nil, err
+	}
+	defer insert.Close()
+
+	args := make([]interface{}, len(result.Columns))
+	for _, row := range result.Rows {
+		for i, value := range row {
+			if value == nil {
+				args[i] = nil
+			} else {
+				args[i] = string(value)
+			}
+		}
+		if _, err := insert.ExecContext(ctx, args...); err != nil {
+			log.Printf("Failed to write SQLite table %s: %v", tableName, err)
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to write SQLite table %s: %v", tableName, err)
+		return nil, err
+	}
+
+	var data []byte
+	err = conn.Raw(func(driverConn interface{}) error {
+		serializer, ok := driverConn.(interface{ Serialize() ([]byte, error) })
+		if !ok {
+			return fmt.Errorf("SQLite driver cannot serialize databases")
+		}
+		data, err = serializer.Serialize()
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to serialize SQLite database: %v", err)
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
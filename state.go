@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultStateFile is the state file used when none is configured.
+const defaultStateFile = "dmdatapushmailer_state.json"
+
+// defaultFileMode is the permission of written files when none is configured.
+const defaultFileMode os.FileMode = 0600
+
+// State represents the data persisted between runs.
+type State struct {
+	Hashes map[string]string `json:"hashes"`
+	// Delivered records, per post identifier, the recipients that already received
+	// the post during the current run
+	Delivered map[string]map[string]bool `json:"delivered"`
+
+	mode os.FileMode
+	mu   sync.Mutex
+}
+
+// newState creates an empty state.
+//
+// @return *State: state
+func newState() *State {
+	return &State{
+		Hashes:    make(map[string]string),
+		Delivered: make(map[string]map[string]bool),
+		mode:      defaultFileMode,
+	}
+}
+
+// hash returns the stored hash for the given key.
+//
+// @param key: hash key
+// @return string: stored hash, empty if none
+func (s *State) hash(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Hashes[key]
+}
+
+// updateHashes stores the given hashes and saves the state to disk.
+//
+// @param statePath: state file path
+// @param hashes: hashes to store
+// @return error: error if any
+func (s *State) updateHashes(statePath string, hashes map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, hash := range hashes {
+		s.Hashes[key] = hash
+	}
+	return saveState(statePath, s)
+}
+
+// loadState reads the state from the given file path. A missing file yields an empty state.
+//
+// @param statePath: state file path
+// @return *State: state
+// @return error: error if any
+func loadState(statePath string) (*State, error) {
+	state := newState()
+
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read state file: %v", err)
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, state); err != nil {
+		log.Printf("Failed to decode state file: %v", err)
+		return nil, err
+	}
+	if state.Hashes == nil {
+		state.Hashes = make(map[string]string)
+	}
+	if state.Delivered == nil {
+		state.Delivered = make(map[string]map[string]bool)
+	}
+
+	return state, nil
+}
+
+// delivered reports whether the post was already delivered to the recipient in this run.
+//
+// @param post: post identifier
+// @param recipient: recipient address
+// @return bool: true if already delivered
+func (s *State) delivered(post string, recipient string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Delivered[post][recipient]
+}
+
+// markDelivered records that the post was delivered to the recipient and saves the state.
+//
+// @param statePath: state file path
+// @param post: post identifier
+// @param recipient: recipient address
+// @return error: error if any
+func (s *State) markDelivered(statePath string, post string, recipient string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Delivered[post] == nil {
+		s.Delivered[post] = make(map[string]bool)
+	}
+	s.Delivered[post][recipient] = true
+	return saveState(statePath, s)
+}
+
+// clearDelivered forgets all delivered recipients at the start of a fresh run and saves the state.
+//
+// @param statePath: state file path
+// @return error: error if any
+func (s *State) clearDelivered(statePath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.Delivered) == 0 {
+		return nil
+	}
+	s.Delivered = make(map[string]map[string]bool)
+	return saveState(statePath, s)
+}
+
+// saveState writes the state to the given file path, replacing it atomically.
+// The caller must hold the state lock.
+//
+// @param statePath: state file path
+// @param state: state
+// @return error: error if any
+func saveState(statePath string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		log.Printf("Failed to encode state: %v", err)
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(statePath), filepath.Base(statePath)+".*.tmp")
+	if err != nil {
+		log.Printf("Failed to create temporary state file: %v", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(state.mode); err != nil {
+		tmp.Close()
+		log.Printf("Failed to set state file permissions: %v", err)
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		log.Printf("Failed to write state file: %v", err)
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		log.Printf("Failed to close state file: %v", err)
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), statePath); err != nil {
+		log.Printf("Failed to replace state file: %v", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultTransformTimeout bounds a transform command when no timeout is configured.
+const defaultTransformTimeout = 5 * time.Minute
+
+// transformAttachment pipes a generated attachment through the configured
+// transform command: the file is written to its standard input and its standard
+// output becomes the attachment. The file name is passed in DMMAILER_FILE_NAME.
+// With transform_extension set, the extension and MIME type follow it.
+//
+// @param ctx: run context
+// @param attachmentConfig: table attachment configuration
+// @param attachment: generated attachment
+// @return Attachment: transformed attachment
+// @return error: error if the command fails, times out or writes nothing
+func transformAttachment(ctx context.Context, attachmentConfig TableAttachmentConfig, attachment Attachment) (Attachment, error) {
+	timeout := defaultTransformTimeout
+	if attachmentConfig.TransformWait > 0 {
+		timeout = time.Duration(attachmentConfig.TransformWait) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	argv := attachmentConfig.TransformCmd
+	logInfof("Transforming %s with %s", attachment.fileName, strings.Join(argv, " "))
+	command := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	command.Env = append(os.Environ(), "DMMAILER_FILE_NAME="+attachment.fileName)
+	command.Stdin = bytes.NewReader(attachment.file.Bytes())
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	err := command.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if message := strings.TrimSpace(stderr.String()); message != "" && err != nil {
+		err = fmt.Errorf("%w: %s", err, message)
+	}
+	if err == nil && stdout.Len() == 0 {
+		err = fmt.Errorf("no output")
+	}
+	if err != nil {
+		log.Printf("Failed to transform %s: %v", attachment.fileName, err)
+		return Attachment{}, fmt.Errorf("transform of %s: %w", attachment.fileName, err)
+	}
+
+	attachment.file = &stdout
+	if ext := attachmentConfig.TransformExt; ext != "" {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		attachment.fileName = strings.TrimSuffix(attachment.fileName, path.Ext(attachment.fileName)) + ext
+		attachment.mimeType = mime.TypeByExtension(ext)
+		if attachment.mimeType == "" {
+			attachment.mimeType = "application/octet-stream"
+		}
+	}
+	return attachment, nil
+}
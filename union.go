@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// defaultSourceColumn names the column holding the source table of each row of
+// a union export when source_column is not set.
+const defaultSourceColumn = "SOURCE_TABLE"
+
+// sourceColumn returns the name of the source table column of a union export.
+//
+// @return string: column name
+func (c TableAttachmentConfig) sourceColumn() string {
+	if c.SourceColumn == "" {
+		return defaultSourceColumn
+	}
+	return c.SourceColumn
+}
+
+// unionSource checks that the tables of a union export have the same columns
+// and returns a subquery combining their rows with UNION ALL, each row preceded
+// by the name of its table. The subquery is used in place of the table name.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param attachmentConfig: table attachment configuration
+// @return string: subquery reading the union
+// @return error: error if any
+func unionSource(ctx context.Context, db queryer, attachmentConfig TableAttachmentConfig) (string, error) {
+	var first []string
+	var firstTypes []string
+	selects := make([]string, 0, len(attachmentConfig.UnionTables))
+	for _, table := range attachmentConfig.UnionTables {
+		columns, types, err := tableColumns(ctx, db, table, attachmentConfig)
+		if err != nil {
+			log.Printf("Failed to read columns of table %s: %v", table, err)
+			return "", err
+		}
+
+		if first == nil {
+			first, firstTypes = columns, types
+			if columnIndex(columns, attachmentConfig.sourceColumn()) >= 0 {
+				err := fmt.Errorf("table %s already has a column %s, set another source_column", table, attachmentConfig.sourceColumn())
+				log.Printf("Failed to combine tables: %v", err)
+				return "", err
+			}
+		} else if err := compareColumns(first, firstTypes, columns, types); err != nil {
+			err = fmt.Errorf("table %s does not match table %s: %w", table, attachmentConfig.UnionTables[0], err)
+			log.Printf("Failed to combine tables: %v", err)
+			return "", err
+		}
+
+		literal := "'" + strings.ReplaceAll(table, "'", "''") + "'"
+		selects = append(selects, fmt.Sprintf("SELECT %s AS %s, UNION_TABLE.* FROM %s UNION_TABLE", literal, attachmentConfig.sourceColumn(), table))
+	}
+	return "(" + strings.Join(selects, " UNION ALL ") + ") UNION_ROWS", nil
+}
+
+// tableColumns returns the column names and types of a table without reading
+// any of its rows.
+//
+// @param ctx: run context
+// @param db: database connection
+// @param table: table name
+// @param attachmentConfig: table attachment configuration
+// @return []string: column names
+// @return []string: column type names
+// @return error: error if any
+func tableColumns(ctx context.Context, db queryer, table string, attachmentConfig TableAttachmentConfig) ([]string, []string, error) {
+	ctx, cancel := attachmentConfig.queryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", table))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	columns := make([]string, len(columnTypes))
+	types := make([]string, len(columnTypes))
+	for i, columnType := range columnTypes {
+		columns[i] = columnType.Name()
+		types[i] = strings.ToUpper(columnType.DatabaseTypeName())
+	}
+	return columns, types, nil
+}
+
+// compareColumns checks that two tables have the same columns, in the same
+// order and with the same types, so that their rows can be combined.
+//
+// @param columns: column names of the first table
+// @param types: column type names of the first table
+// @param otherColumns: column names of the other table
+// @param otherTypes: column type names of the other table
+// @return error: the first difference, nil if the columns match
+func compareColumns(columns, types, otherColumns, otherTypes []string) error {
+	if len(columns) != len(otherColumns) {
+		return fmt.Errorf("%d columns instead of %d", len(otherColumns), len(columns))
+	}
+	for i := range columns {
+		if !strings.EqualFold(columns[i], otherColumns[i]) {
+			return fmt.Errorf("column #%d is %s instead of %s", i+1, otherColumns[i], columns[i])
+		}
+		if types[i] != otherTypes[i] {
+			return fmt.Errorf("column %s is %s instead of %s", columns[i], otherTypes[i], types[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// uploadTimeout bounds a single attachment upload.
+const uploadTimeout = 5 * time.Minute
+
+// UploadConfig represents the HTTP endpoint large attachments are uploaded to,
+// so that the email links to them instead of carrying them.
+type UploadConfig struct {
+	URL            string            `json:"url"`
+	DownloadURL    string            `json:"download_url"`
+	Headers        map[string]string `json:"headers"`
+	ThresholdBytes int               `json:"threshold_bytes"`
+}
+
+// defaultUploadThreshold is the size above which attachments are uploaded when
+// threshold_bytes is not set.
+const defaultUploadThreshold = 10 << 20
+
+// threshold returns the size in bytes above which attachments are uploaded,
+// defaulting to 10 MiB.
+//
+// @return int: upload threshold in bytes
+func (u *UploadConfig) threshold() int {
+	if u.ThresholdBytes <= 0 {
+		return defaultUploadThreshold
+	}
+	return u.ThresholdBytes
+}
+
+// uploadObjectPath returns the path an attachment is uploaded to below the
+// configured URL: a directory named after the upload time and a hash of the
+// content, so that posts uploading a file of the same name at the same time do
+// not overwrite each other.
+//
+// @param attachment: attachment to upload
+// @param now: upload time
+// @return string: object path
+func uploadObjectPath(attachment Attachment, now time.Time) string {
+	sum := sha256.Sum256(attachment.file.Bytes())
+	return now.Format("20060102150405") + "-" + hex.EncodeToString(sum[:6]) + "/" + url.PathEscape(attachment.fileName)
+}
+
+// uploadAttachment uploads an attachment with an HTTP PUT below the configured
+// URL and returns its download URL.
+//
+// @param ctx: run context; cancelling it aborts the upload
+// @param upload: upload configuration
+// @param attachment: attachment to upload
+// @param now: upload time
+// @return string: download URL
+// @return error: error if any
+func uploadAttachment(ctx context.Context, upload *UploadConfig, attachment Attachment, now time.Time) (string, error) {
+	objectPath := uploadObjectPath(attachment, now)
+	target := strings.TrimSuffix(upload.URL, "/") + "/" + objectPath
+	logInfof("Uploading attachment %s to %s", attachment.fileName, target)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(attachment.file.Bytes()))
+	if err != nil {
+		log.Printf("Failed to create upload request: %v", err)
+		return "", err
+	}
+	request.Header.Set("Content-Type", attachment.mimeType)
+	for key, value := range upload.Headers {
+		request.Header.Set(key, value)
+	}
+
+	client := &http.Client{Timeout: uploadTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		log.Printf("Failed to upload attachment %s: %v", attachment.fileName, err)
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err := fmt.Errorf("upload of %s failed with status %s", attachment.fileName, response.Status)
+		log.Printf("Failed to upload attachment: %v", err)
+		return "", err
+	}
+
+	downloadURL := upload.DownloadURL
+	if downloadURL == "" {
+		downloadURL = upload.URL
+	}
+	return strings.TrimSuffix(downloadURL, "/") + "/" + objectPath, nil
+}
+
+// uploadedFile is an attachment uploaded instead of attached, with its download URL.
+type uploadedFile struct {
+	fileName    string
+	downloadURL string
+}
+
+// uploadLargeAttachments uploads the attachments larger than the threshold and
+// returns the remaining attachments together with the uploaded files. The
+// download links are added to each recipient's body separately, so that they
+// only name the files the recipient may receive.
+//
+// @param ctx: run context
+// @param upload: upload configuration
+// @param attachments: attachments of the post
+// @return []Attachment: attachments small enough to send inline
+// @return []uploadedFile: uploaded files
+// @return error: error if any
+func uploadLargeAttachments(ctx context.Context, upload *UploadConfig, attachments []Attachment) ([]Attachment, []uploadedFile, error) {
+	now := time.Now()
+	inline := make([]Attachment, 0, len(attachments))
+	uploaded := make([]uploadedFile, 0)
+	for _, attachment := range attachments {
+		if attachment.file.Len() <= upload.threshold() {
+			inline = append(inline, attachment)
+			continue
+		}
+
+		downloadURL, err := uploadAttachment(ctx, upload, attachment, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		uploaded = append(uploaded, uploadedFile{fileName: attachment.fileName, downloadURL: downloadURL})
+	}
+	return inline, uploaded, nil
+}
+
+// appendDownloadLinks extends a body by a download link for each uploaded file
+// among the files of the recipient.
+//
+// @param body: email body
+// @param uploaded: uploaded files of the post
+// @param files: attachments the recipient receives, before uploading
+// @return string: body with the download links
+func appendDownloadLinks(body string, uploaded []uploadedFile, files []Attachment) string {
+	links := make([]string, 0, len(uploaded))
+	for _, file := range uploaded {
+		for _, attachment := range files {
+			if attachment.fileName == file.fileName {
+				links = append(links, fmt.Sprintf("- %s: %s", file.fileName, file.downloadURL))
+				break
+			}
+		}
+	}
+
+	if len(links) > 0 {
+		body += "\r\n\r\nDownload links:\r\n\r\n" + strings.Join(links, "\r\n")
+	}
+	return body
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUploadLargeAttachments(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			t.Errorf("method = %s, want PUT", r.Method)
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		objects[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	upload := &UploadConfig{URL: server.URL + "/reports/", DownloadURL: "https://files.example.com/reports", ThresholdBytes: 4}
+	// Two posts upload a file of the same name in the same second
+	var links []string
+	for _, data := range []string{"sales of north", "sales of south"} {
+		attachments := []Attachment{
+			{fileName: "small.csv", file: bytes.NewBufferString("1,2")},
+			{fileName: "report 1.csv", file: bytes.NewBufferString(data)},
+		}
+		inline, uploaded, err := uploadLargeAttachments(context.Background(), upload, attachments)
+		if err != nil {
+			t.Fatalf("uploadLargeAttachments: %v", err)
+		}
+		if len(inline) != 1 || inline[0].fileName != "small.csv" {
+			t.Errorf("inline attachments = %v, want small.csv only", inline)
+		}
+		if len(uploaded) != 1 || !strings.HasPrefix(uploaded[0].downloadURL, "https://files.example.com/reports/") || !strings.HasSuffix(uploaded[0].downloadURL, "/report%201.csv") {
+			t.Fatalf("uploaded = %+v", uploaded)
+		}
+		links = append(links, uploaded[0].downloadURL)
+	}
+
+	if links[0] == links[1] {
+		t.Errorf("both uploads went to %s", links[0])
+	}
+	if len(objects) != 2 {
+		t.Errorf("server holds %d objects, want 2: %v", len(objects), objects)
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		attachments := []Attachment{{fileName: "report.csv", file: bytes.NewBufferString("large enough")}}
+		if _, _, err := uploadLargeAttachments(ctx, upload, attachments); err == nil {
+			t.Error("uploadLargeAttachments with a cancelled context succeeded")
+		}
+	})
+}
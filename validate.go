@@ -0,0 +1,644 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// validateConfig checks the configuration without connecting to the database or
+// SMTP servers.
+//
+// @param config: configuration
+// @return []string: issues found, empty if the configuration is valid
+func validateConfig(config *Config) []string {
+	issues := make([]string, 0)
+	addIssue := func(format string, args ...interface{}) {
+		issues = append(issues, fmt.Sprintf(format, args...))
+	}
+
+	emails := map[string]EmailConfig{"email": config.Email}
+	for name, profile := range config.EmailProfiles {
+		emails[fmt.Sprintf("email_profiles: %s", name)] = profile
+	}
+	labels := make([]string, 0, len(emails))
+	for label := range emails {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	for _, label := range labels {
+		if bounce := emails[label].Bounce; bounce != "" {
+			if _, err := mail.ParseAddress(bounce); err != nil {
+				addIssue("%s: bounce_address: invalid address %q", label, bounce)
+			}
+		}
+		servers := emails[label].smtpServers()
+		if len(servers) == 0 {
+			addIssue("%s: no SMTP server configured", label)
+		}
+		for i, server := range servers {
+			if server.Host == "" {
+				addIssue("%s: server #%d: host is empty", label, i+1)
+			}
+			if server.Port < 1 || server.Port > 65535 {
+				addIssue("%s: server #%d: port %d is out of range", label, i+1, server.Port)
+			}
+			if server.Timeout < 0 {
+				addIssue("%s: server #%d: smtp_timeout_seconds must not be negative", label, i+1)
+			}
+			switch server.TLSMode {
+			case "", tlsModeImplicit, tlsModeStartTLS:
+				if server.Plain && server.TLSMode != "" {
+					addIssue("%s: server #%d: tls_mode cannot be combined with plain", label, i+1)
+				}
+			default:
+				addIssue("%s: server #%d: tls_mode must be tls or starttls", label, i+1)
+			}
+		}
+	}
+
+	dbConfigs := map[string]DBConfig{"db": config.DB}
+	for name, dbConfig := range config.Databases {
+		dbConfigs[fmt.Sprintf("databases: %s", name)] = dbConfig
+	}
+	dbLabels := make([]string, 0, len(dbConfigs))
+	for label := range dbConfigs {
+		dbLabels = append(dbLabels, label)
+	}
+	sort.Strings(dbLabels)
+
+	for _, label := range dbLabels {
+		dbConfig := dbConfigs[label]
+		if dbConfig.Host == "" || dbConfig.Username == "" || dbConfig.Password == "" {
+			addIssue("%s: host, username and password are required", label)
+		}
+		if dbConfig.Port < 1 || dbConfig.Port > 65535 {
+			addIssue("%s: port %d is out of range", label, dbConfig.Port)
+		}
+		if dbConfig.SSL {
+			if dbConfig.SSLCertPath == "" || dbConfig.SSLKeyPath == "" {
+				addIssue("%s: ssl_cert_path and ssl_key_path are required when ssl is enabled", label)
+			} else if _, err := tls.LoadX509KeyPair(dbConfig.SSLCertPath, dbConfig.SSLKeyPath); err != nil {
+				addIssue("%s: invalid SSL client certificate: %v", label, err)
+			}
+		}
+	}
+
+	if config.CronFormat != "" && config.CronFormat != cronFormatStandard && config.CronFormat != cronFormatWithSeconds {
+		addIssue("cron_format: must be standard or with_seconds")
+	} else if _, err := config.parseSchedule(); err != nil {
+		source := "time"
+		if os.Getenv(scheduleEnv) != "" {
+			source += " (from " + scheduleEnv + ")"
+		}
+		addIssue("%s: invalid cron expression %q: %v", source, config.Time, err)
+	}
+
+	if config.SelfTestStrict && !config.StartupSelfTest {
+		addIssue("startup_selftest_strict: requires startup_selftest")
+	}
+
+	if config.Heartbeat != nil && config.Heartbeat.To != "" && config.Heartbeat.From == "" {
+		addIssue("heartbeat_email: from is empty")
+	}
+	if config.AdminEmail != nil && config.AdminEmail.To != "" && config.AdminEmail.From == "" {
+		addIssue("admin_email: from is empty")
+	}
+
+	if config.Retries < 0 || config.RetryDelaySeconds < 0 {
+		addIssue("retries: retries and retry_delay_seconds must not be negative")
+	}
+
+	if !validEncoding(config.AttachmentEncoding) {
+		addIssue("attachment_encoding: unsupported encoding %q", config.AttachmentEncoding)
+	}
+
+	if upload := config.Upload; upload != nil && upload.URL != "" {
+		if parsed, err := url.Parse(upload.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			addIssue("upload: url must be an http or https URL")
+		}
+		if upload.ThresholdBytes < 0 {
+			addIssue("upload: threshold_bytes must not be negative")
+		}
+	}
+
+	if config.LogLevel != "" && config.LogLevel != logLevelDebug && config.LogLevel != logLevelInfo && config.LogLevel != logLevelWarn {
+		addIssue("log_level: must be debug, info or warn")
+	}
+	if _, ok := logTimestamps[config.LogTimestamp]; config.LogTimestamp != "" && !ok {
+		addIssue("log_timestamp: must be none, seconds or microseconds")
+	}
+	if config.DebugDumpMessages && config.LogLevel != logLevelDebug {
+		addIssue("debug_dump_messages: requires log_level debug")
+	}
+
+	if config.SMTPFailureLimit < 0 {
+		addIssue("smtp_failure_threshold: must not be negative")
+	}
+
+	if config.RejectedRetries < 0 || config.RejectedRetryDelay < 0 {
+		addIssue("rejected_recipient_retries and rejected_recipient_retry_delay_seconds must not be negative")
+	}
+
+	if config.DBConnectRetries < 0 || config.DBRetryDelay < 0 {
+		addIssue("db_connect_retries and db_connect_retry_delay_seconds must not be negative")
+	}
+
+	if config.QueryTimeout < 0 {
+		addIssue("query_timeout_seconds: must be positive")
+	}
+
+	if config.MaxLOBLength < 0 {
+		addIssue("max_lob_length: must be positive")
+	}
+
+	if config.MaxRunSeconds < 0 {
+		addIssue("max_run_seconds: must not be negative")
+	}
+
+	for _, format := range config.DefaultFormats {
+		if !supportedFormat(format) {
+			addIssue("default_formats: unsupported format %q", format)
+		}
+	}
+
+	if config.PostDelaySeconds < 0 {
+		addIssue("post_delay_seconds: must not be negative")
+	}
+
+	if config.MaxSMTPConnections < 0 {
+		addIssue("max_smtp_connections: must not be negative")
+	}
+
+	if config.PostRunTimeout < 0 {
+		addIssue("post_run_command_timeout_seconds: must not be negative")
+	}
+	if config.PostRunTimeout > 0 && config.PostRunCommand == "" {
+		addIssue("post_run_command_timeout_seconds: requires post_run_command")
+	}
+
+	if config.PostConcurrency < 0 {
+		addIssue("post_concurrency: must not be negative")
+	}
+
+	if config.MaxBodyLength < 0 {
+		addIssue("max_body_length: must not be negative")
+	}
+
+	if _, err := config.fileMode(); err != nil {
+		addIssue("file_mode: %v", err)
+	}
+
+	if _, err := config.dateLayout(); err != nil {
+		addIssue("file_date_format: %v", err)
+	}
+
+	if _, err := config.failureThreshold(len(config.Post)); err != nil {
+		addIssue("failure_threshold: %v", err)
+	}
+
+	if len(config.Post) == 0 {
+		addIssue("post: no post configured")
+	}
+	postKeys := make(map[string]bool, len(config.Post))
+	for i, post := range config.Post {
+		prefix := fmt.Sprintf("post #%d", i+1)
+		if key := config.postKey(i); postKeys[key] {
+			addIssue("%s: id: %q is already used by another post", prefix, key)
+		} else {
+			postKeys[key] = true
+		}
+		if post.From == "" {
+			addIssue("%s: from is empty", prefix)
+		}
+		if len(post.To) == 0 && post.RecipientsQuery == "" && post.RecipientsFile == "" {
+			addIssue("%s: to, recipients_query and recipients_file are all empty", prefix)
+		}
+		if post.RecipientsColumn != "" && post.RecipientsFile == "" {
+			addIssue("%s: recipients_file_column: requires recipients_file", prefix)
+		}
+
+		if _, ok := config.EmailProfiles[post.EmailProfile]; post.EmailProfile != "" && !ok {
+			addIssue("%s: email_profile: unknown profile %q", prefix, post.EmailProfile)
+		}
+
+		if post.BodyType != "" && post.BodyType != bodyTypeText && post.BodyType != bodyTypeMarkdown {
+			addIssue("%s: body_type: must be text or markdown", prefix)
+		}
+
+		if _, ok := priorityHeaders[post.Priority]; post.Priority != "" && !ok {
+			addIssue("%s: priority: must be high, normal or low", prefix)
+		}
+
+		for _, holiday := range post.Holidays {
+			if _, err := time.Parse(holidayLayout, holiday); err != nil {
+				addIssue("%s: holidays: invalid date %q, expected YYYY-MM-DD", prefix, holiday)
+			}
+		}
+
+		for address := range post.RecipientAttachments {
+			if _, err := mail.ParseAddress(address); err != nil {
+				addIssue("%s: recipient_attachments: invalid address %q", prefix, address)
+			}
+		}
+
+		for _, format := range post.DefaultFormats {
+			if !supportedFormat(format) {
+				addIssue("%s: default_formats: unsupported format %q", prefix, format)
+			}
+		}
+
+		if post.CSVZip != "" {
+			if err := validateFileName(post.CSVZip); err != nil {
+				addIssue("%s: csv_zip: %v", prefix, err)
+			}
+		}
+
+		fileNames := make(map[string]bool)
+		for j, attachment := range post.Attachment {
+			attachmentPrefix := fmt.Sprintf("%s: attachment #%d", prefix, j+1)
+			if post.CSVZip != "" {
+				if (attachment.Table == "" && len(attachment.UnionTables) == 0) || attachment.File != "" {
+					addIssue("%s: csv_zip only supports table exports", attachmentPrefix)
+				}
+				attachment.Formats = []string{formatCSV}
+			}
+			if _, ok := config.Databases[attachment.Database]; attachment.Database != "" && !ok {
+				addIssue("%s: database: unknown database %q", attachmentPrefix, attachment.Database)
+			}
+			for _, issue := range validateAttachment(attachment) {
+				addIssue("%s: %s", attachmentPrefix, issue)
+			}
+			if attachment.PageSize > 0 && post.CombinedWorkbook != "" {
+				addIssue("%s: page_size: not supported with combined_workbook", attachmentPrefix)
+			}
+
+			for _, fileName := range attachment.fileNames() {
+				if fileNames[fileName] {
+					addIssue("%s: duplicate file name %q", attachmentPrefix, fileName)
+				}
+				fileNames[fileName] = true
+			}
+		}
+
+		// Names resolved from the data are only known at run time
+		templated := false
+		for fileName := range fileNames {
+			templated = templated || strings.Contains(fileName, "{{")
+		}
+		// Recipients of a zipped post can only select the archive
+		if post.CSVZip != "" {
+			fileNames, templated = map[string]bool{post.CSVZip: true}, false
+		}
+		if post.CombinedWorkbook != "" {
+			if err := validateFileName(post.CombinedWorkbook); err != nil {
+				addIssue("%s: combined_workbook: %v", prefix, err)
+			}
+			if fileNames[post.CombinedWorkbook] {
+				addIssue("%s: combined_workbook: duplicate file name %q", prefix, post.CombinedWorkbook)
+			}
+			fileNames[post.CombinedWorkbook] = true
+		}
+		for address, names := range post.RecipientAttachments {
+			for _, name := range names {
+				if !fileNames[name] && !templated {
+					addIssue("%s: recipient_attachments: %s: unknown attachment %q", prefix, address, name)
+				}
+			}
+		}
+	}
+
+	return issues
+}
+
+// validateAttachment checks a single attachment configuration.
+//
+// @param attachment: table attachment configuration
+// @return []string: issues found
+func validateAttachment(attachment TableAttachmentConfig) []string {
+	issues := make([]string, 0)
+
+	if !validEncoding(attachment.Encoding) {
+		issues = append(issues, fmt.Sprintf("encoding: unsupported encoding %q", attachment.Encoding))
+	}
+
+	if attachment.MimeType != "" {
+		if _, _, err := mime.ParseMediaType(attachment.MimeType); err != nil {
+			issues = append(issues, fmt.Sprintf("mime_type: invalid MIME type %q: %v", attachment.MimeType, err))
+		}
+	}
+
+	if attachment.SchemaOnly && (attachment.Table == "" || attachment.File != "" || attachment.Template != "" || len(attachment.Queries) > 0) {
+		issues = append(issues, "schema_only: only supported for table exports")
+	}
+	maskColumns := make([]string, 0, len(attachment.Mask))
+	for column := range attachment.Mask {
+		maskColumns = append(maskColumns, column)
+	}
+	sort.Strings(maskColumns)
+	for _, column := range maskColumns {
+		if mode := attachment.Mask[column]; mode != maskFull && mode != maskLast4 && mode != maskHash {
+			issues = append(issues, fmt.Sprintf("mask: column %s: must be full, last4 or hash", column))
+		}
+	}
+	typeColumns := make([]string, 0, len(attachment.ColumnTypes))
+	for column := range attachment.ColumnTypes {
+		typeColumns = append(typeColumns, column)
+	}
+	sort.Strings(typeColumns)
+	for _, column := range typeColumns {
+		if columnType := attachment.ColumnTypes[column]; columnType != columnTypeText && columnType != columnTypeNumber && columnType != columnTypeDate {
+			issues = append(issues, fmt.Sprintf("column_types: column %s: must be text, number or date", column))
+		}
+	}
+	if len(attachment.TransformCmd) > 0 {
+		if _, err := exec.LookPath(attachment.TransformCmd[0]); err != nil {
+			issues = append(issues, fmt.Sprintf("transform_command: %v", err))
+		}
+	} else if attachment.TransformExt != "" || attachment.TransformWait != 0 {
+		issues = append(issues, "transform_extension and transform_timeout_seconds require transform_command")
+	}
+	if attachment.TransformWait < 0 {
+		issues = append(issues, "transform_timeout_seconds: must not be negative")
+	}
+	if strings.ContainsAny(attachment.TransformExt, `/\`) {
+		issues = append(issues, fmt.Sprintf("transform_extension: invalid extension %q", attachment.TransformExt))
+	}
+	if attachment.Refresh && (attachment.Table == "" || attachment.File != "" || attachment.Template != "" || len(attachment.Queries) > 0) {
+		issues = append(issues, "refresh: only supported for table exports")
+	}
+
+	if sheet := attachment.GoogleSheet; sheet != nil {
+		if (attachment.Table == "" && len(attachment.UnionTables) == 0) || attachment.Template != "" || len(attachment.Queries) > 0 {
+			issues = append(issues, "google_sheet: only supported for table exports")
+		}
+		if sheet.CredentialsFile == "" || sheet.SpreadsheetID == "" || sheet.Range == "" {
+			issues = append(issues, "google_sheet: credentials_file, spreadsheet_id and range are required")
+		} else if _, err := os.Stat(sheet.CredentialsFile); err != nil {
+			issues = append(issues, fmt.Sprintf("google_sheet: %v", err))
+		}
+	}
+
+	if attachment.File != "" {
+		if attachment.Table != "" || len(attachment.UnionTables) > 0 || attachment.Template != "" || len(attachment.Queries) > 0 {
+			issues = append(issues, "file cannot be combined with table, union_tables, template or queries")
+		}
+		if attachment.Excel != "" {
+			if err := validateFileName(attachment.Excel); err != nil {
+				issues = append(issues, fmt.Sprintf("excel: %v", err))
+			}
+		}
+		return issues
+	}
+
+	if err := validateFileName(attachment.Excel); err != nil {
+		issues = append(issues, fmt.Sprintf("excel: %v", err))
+	}
+	if strings.Contains(attachment.Excel, "{{") {
+		if attachment.Template != "" || len(attachment.Queries) > 0 {
+			issues = append(issues, "excel: file name templates are only supported for table exports")
+		} else if _, err := template.New("file name").Parse(attachment.Excel); err != nil {
+			issues = append(issues, fmt.Sprintf("excel: invalid file name template: %v", err))
+		}
+	}
+
+	if attachment.Template != "" {
+		if len(attachment.Cells) == 0 {
+			issues = append(issues, "template: no cells configured")
+		}
+		return append(issues, validateTemplate(attachment)...)
+	}
+
+	if len(attachment.Queries) > 0 {
+		if attachment.Table != "" || len(attachment.UnionTables) > 0 {
+			issues = append(issues, "queries cannot be combined with table or union_tables")
+		}
+		for i, query := range attachment.Queries {
+			if strings.TrimSpace(query.Query) == "" {
+				issues = append(issues, fmt.Sprintf("queries: query #%d is empty", i+1))
+			}
+		}
+		return issues
+	}
+
+	if len(attachment.UnionTables) > 0 {
+		if attachment.Table != "" {
+			issues = append(issues, "union_tables cannot be combined with table")
+		}
+		if len(attachment.UnionTables) < 2 {
+			issues = append(issues, "union_tables: at least two tables are required")
+		}
+		if attachment.SourceColumn != "" && !columnNamePattern.MatchString(attachment.SourceColumn) {
+			issues = append(issues, fmt.Sprintf("source_column: invalid column name %q", attachment.SourceColumn))
+		}
+	} else if attachment.Table == "" {
+		issues = append(issues, "table is empty")
+	}
+	for _, pattern := range attachment.ExcludeColumns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			issues = append(issues, fmt.Sprintf("exclude_columns: invalid pattern %q", pattern))
+		}
+	}
+	if chart := attachment.Chart; chart != nil {
+		if _, ok := chartTypes[chart.Type]; !ok {
+			issues = append(issues, fmt.Sprintf("chart: unsupported type %q", chart.Type))
+		}
+		if chart.Category == "" || len(chart.Values) == 0 {
+			issues = append(issues, "chart: category and values are required")
+		}
+	}
+	for _, orderBy := range attachment.OrderBy {
+		if !orderByPattern.MatchString(orderBy) {
+			issues = append(issues, fmt.Sprintf("order_by: invalid column %q, expected a column name optionally followed by ASC or DESC", orderBy))
+		}
+	}
+	for _, column := range attachment.GroupBy {
+		if !columnNamePattern.MatchString(column) {
+			issues = append(issues, fmt.Sprintf("group_by: invalid column %q", column))
+		}
+	}
+	for i, aggregate := range attachment.Aggregate {
+		if !aggregateFunctions[strings.ToLower(aggregate.Function)] {
+			issues = append(issues, fmt.Sprintf("aggregate #%d: function must be sum, avg, count, min or max, got %q", i+1, aggregate.Function))
+		}
+		if !columnNamePattern.MatchString(aggregate.Column) && !(aggregate.Column == "*" && strings.EqualFold(aggregate.Function, "count")) {
+			issues = append(issues, fmt.Sprintf("aggregate #%d: invalid column %q", i+1, aggregate.Column))
+		}
+		if aggregate.Alias != "" && !columnNamePattern.MatchString(aggregate.Alias) {
+			issues = append(issues, fmt.Sprintf("aggregate #%d: invalid alias %q", i+1, aggregate.Alias))
+		}
+	}
+	if len(attachment.GroupBy) > 0 && len(attachment.Aggregate) == 0 {
+		issues = append(issues, "group_by: aggregate is required")
+	}
+	if attachment.Limit < 0 {
+		issues = append(issues, "limit: must not be negative")
+	}
+	if attachment.QueryTimeout < 0 {
+		issues = append(issues, "query_timeout_seconds: must be positive")
+	}
+	if attachment.MaxLOBLength < 0 {
+		issues = append(issues, "max_lob_length: must be positive")
+	}
+	if layout := attachment.Print; layout != nil {
+		if layout.Orientation != "" && layout.Orientation != "portrait" && layout.Orientation != "landscape" {
+			issues = append(issues, "print: orientation must be portrait or landscape")
+		}
+		if len(layout.Header) > 255 || len(layout.Footer) > 255 {
+			issues = append(issues, "print: header and footer must not exceed 255 characters")
+		}
+	}
+	if attachment.ExportRetries < 0 {
+		issues = append(issues, "export_retries: must not be negative")
+	}
+	if attachment.PageSize < 0 {
+		issues = append(issues, "page_size: must not be negative")
+	}
+	if attachment.PageSize > 0 && len(attachment.OrderBy) == 0 {
+		issues = append(issues, "page_size: order_by is required so that pages do not overlap")
+	}
+	// Paged tables are streamed to the files, so options needing every row at
+	// once are not available
+	if attachment.PageSize > 0 {
+		for _, format := range attachment.formats() {
+			if format != formatXLSX && format != formatCSV {
+				issues = append(issues, fmt.Sprintf("page_size: format %s is not supported, only xlsx and csv", format))
+			}
+		}
+		unsupported := []struct {
+			option string
+			set    bool
+		}{
+			{"split_by", attachment.SplitBy != ""},
+			{"totals", len(attachment.Totals) > 0},
+			{"conditional_formats", len(attachment.Conditional) > 0},
+			{"chart", attachment.Chart != nil},
+			{"print", attachment.Print != nil},
+			{"google_sheet", attachment.GoogleSheet != nil},
+			{"styles.data", attachment.Styles != nil && attachment.Styles.Data != nil},
+			{"styles.banded", attachment.Styles != nil && attachment.Styles.Banded != nil},
+		}
+		for _, u := range unsupported {
+			if u.set {
+				issues = append(issues, fmt.Sprintf("page_size: not supported with %s", u.option))
+			}
+		}
+	}
+	switch attachment.BinaryColumns {
+	case "", binaryPlaceholder, binaryBase64, binaryOmit:
+	default:
+		issues = append(issues, fmt.Sprintf("binary_columns: must be placeholder, base64 or omit, got %q", attachment.BinaryColumns))
+	}
+	if attachment.MaxSheets < 0 {
+		issues = append(issues, "max_sheets: must not be negative")
+	}
+	for _, rule := range attachment.Conditional {
+		switch rule.Rule {
+		case ruleNegativeRed, rulePositiveGreen, ruleColorScale, ruleDataBar:
+		case ruleCell:
+			if rule.Criteria == "" || rule.Value == "" {
+				issues = append(issues, fmt.Sprintf("conditional_formats: column %s: criteria and value are required", rule.Column))
+			}
+		default:
+			issues = append(issues, fmt.Sprintf("conditional_formats: column %s: unknown rule %q", rule.Column, rule.Rule))
+		}
+	}
+	for _, format := range attachment.Formats {
+		if !supportedFormat(format) {
+			issues = append(issues, fmt.Sprintf("formats: unsupported format %q", format))
+		}
+	}
+	if _, err := attachment.csvComma(); err != nil {
+		issues = append(issues, fmt.Sprintf("csv_delimiter: %v", err))
+	}
+
+	return issues
+}
+
+// orderByPattern matches an order_by entry: a column name, optionally followed
+// by a sort direction.
+var orderByPattern = regexp.MustCompile(`(?i)^[A-Z_][A-Z0-9_$#]*(\s+(ASC|DESC))?$`)
+
+// columnNamePattern matches a plain column name.
+var columnNamePattern = regexp.MustCompile(`(?i)^[A-Z_][A-Z0-9_$#]*$`)
+
+// validEncoding reports whether the attachment transfer encoding is supported.
+// An empty encoding selects the default.
+//
+// @param encoding: transfer encoding
+// @return bool: true if supported
+func validEncoding(encoding string) bool {
+	switch encoding {
+	case "", encodingBase64, encodingQuotedPrintable, encoding8Bit:
+		return true
+	}
+	return false
+}
+
+// validateFileName checks that an attachment file name is usable in a
+// Content-Disposition header and does not contain a path.
+//
+// @param fileName: attachment file name
+// @return error: error if the file name is invalid
+func validateFileName(fileName string) error {
+	if fileName == "" {
+		return fmt.Errorf("file name is empty")
+	}
+	if fileName == "." || fileName == ".." || strings.ContainsAny(fileName, "/\\") {
+		return fmt.Errorf("file name %q must not contain a path", fileName)
+	}
+	for _, r := range fileName {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return fmt.Errorf("file name %q contains invalid characters", fileName)
+		}
+	}
+	return nil
+}
+
+// validateTemplate opens the template workbook of an attachment and checks that
+// every named range or cell it fills exists.
+//
+// @param attachment: template attachment configuration
+// @return []string: issues found
+func validateTemplate(attachment TableAttachmentConfig) []string {
+	file, err := excelize.OpenFile(attachment.Template)
+	if err != nil {
+		return []string{fmt.Sprintf("template: cannot open %s: %v", attachment.Template, err)}
+	}
+	defer file.Close()
+
+	refs := make([]string, 0, len(attachment.Cells))
+	for ref := range attachment.Cells {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+
+	issues := make([]string, 0)
+	for _, ref := range refs {
+		if _, _, err := resolveTemplateCell(file, ref); err != nil {
+			issues = append(issues, fmt.Sprintf("template: %v", err))
+		}
+	}
+	return issues
+}
+
+// supportedFormat reports whether a table attachment can be written in a format.
+//
+// @param format: attachment format
+// @return bool: true if the format is supported
+func supportedFormat(format string) bool {
+	return format == formatXLSX || format == formatCSV || format == formatSQLite
+}
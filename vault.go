@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultPrefix marks config values read from HashiCorp Vault, written as
+// "vault:<path>#<key>", e.g. "vault:secret/data/smtp#password".
+const vaultPrefix = "vault:"
+
+// vaultTimeout bounds a single request to Vault.
+const vaultTimeout = 30 * time.Second
+
+// vaultCache holds the secrets read from Vault by path for the process lifetime.
+var vaultCache = struct {
+	secrets map[string]map[string]interface{}
+	mu      sync.Mutex
+}{secrets: make(map[string]map[string]interface{})}
+
+// resolveVaultSecrets replaces every string value of the configuration that
+// references a Vault secret with the secret. Vault is only contacted when such
+// a reference exists; its address and token are read from VAULT_ADDR and
+// VAULT_TOKEN.
+//
+// @param ctx: context of the Vault requests
+// @param config: configuration
+// @return error: error if any
+func resolveVaultSecrets(ctx context.Context, config *Config) error {
+	return resolveVaultValue(ctx, reflect.ValueOf(config).Elem())
+}
+
+// resolveVaultValue resolves the Vault references within a value.
+//
+// @param ctx: context of the Vault requests
+// @param value: settable value
+// @return error: error if any
+func resolveVaultValue(ctx context.Context, value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			return resolveVaultValue(ctx, value.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).IsExported() {
+				if err := resolveVaultValue(ctx, value.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := resolveVaultValue(ctx, value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		// Map elements cannot be set in place, resolve a copy and store it back
+		for _, key := range value.MapKeys() {
+			element := reflect.New(value.Type().Elem()).Elem()
+			element.Set(value.MapIndex(key))
+			if err := resolveVaultValue(ctx, element); err != nil {
+				return err
+			}
+			value.SetMapIndex(key, element)
+		}
+	case reflect.String:
+		if ref, ok := strings.CutPrefix(value.String(), vaultPrefix); ok {
+			secret, err := readVaultSecret(ctx, ref)
+			if err != nil {
+				return fmt.Errorf("%s%s: %w", vaultPrefix, ref, err)
+			}
+			value.SetString(secret)
+		}
+	}
+	return nil
+}
+
+// readVaultSecret returns the value of a Vault secret reference "<path>#<key>".
+// Both KV version 1 and version 2 responses are supported.
+//
+// @param ctx: context of the Vault request
+// @param ref: secret reference without the vault: prefix
+// @return string: secret value
+// @return error: error if any
+func readVaultSecret(ctx context.Context, ref string) (string, error) {
+	secretPath, key, ok := strings.Cut(ref, "#")
+	if !ok || secretPath == "" || key == "" {
+		return "", errors.New("expected vault:<path>#<key>")
+	}
+
+	vaultCache.mu.Lock()
+	defer vaultCache.mu.Unlock()
+
+	secrets, ok := vaultCache.secrets[secretPath]
+	if !ok {
+		var err error
+		if secrets, err = fetchVaultSecrets(ctx, secretPath); err != nil {
+			return "", err
+		}
+		vaultCache.secrets[secretPath] = secrets
+	}
+
+	value, ok := secrets[key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found", key)
+	}
+	if text, ok := value.(string); ok {
+		return text, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// fetchVaultSecrets reads the key/value pairs stored at a Vault path.
+//
+// @param ctx: context of the Vault request
+// @param secretPath: secret path, e.g. secret/data/smtp
+// @return map[string]interface{}: secret key/value pairs
+// @return error: error if any
+func fetchVaultSecrets(ctx context.Context, secretPath string) (map[string]interface{}, error) {
+	address, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if address == "" || token == "" {
+		return nil, errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	logInfof("Reading secret %s from Vault", secretPath)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+
+	client := &http.Client{Timeout: vaultTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("request failed with status %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	// KV version 2 nests the secret below data.data, next to its metadata
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := body.Data["metadata"]; hasMetadata {
+			return nested, nil
+		}
+	}
+	return body.Data, nil
+}